@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"net/mail"
+	"strings"
+
+	"github.com/pulumi/pulumi-digitalocean/sdk/v4/go/digitalocean"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+// alertsSpec installs DigitalOcean's monitoring agent on the droplets and
+// alerts the given targets when their CPU or memory use stays high.
+// Installing the agent replaces droplets created without it.
+type alertsSpec struct {
+	Enabled       bool    `json:"enabled"`
+	CPUPercent    float64 `json:"cpuPercent"`
+	MemoryPercent float64 `json:"memoryPercent"`
+	// Window is how long a threshold must be crossed: 5m, 10m, 30m or 1h.
+	Window       string   `json:"window"`
+	Emails       []string `json:"emails"`
+	SlackChannel string   `json:"slackChannel"`
+	// PlainSlackURL is only read to reject a webhook left in plain config.
+	PlainSlackURL string `json:"slackUrl"`
+	// SlackURL is the alertsSlackUrl secret, which HasSlackURL says is set.
+	SlackURL    pulumi.StringOutput `json:"-"`
+	HasSlackURL bool                `json:"-"`
+}
+
+var defaultAlerts = alertsSpec{
+	CPUPercent:    90,
+	MemoryPercent: 90,
+	Window:        "5m",
+}
+
+func (a alertsSpec) validate() error {
+	if !a.Enabled {
+		return nil
+	}
+	var problems []string
+	for name, value := range map[string]float64{"cpuPercent": a.CPUPercent, "memoryPercent": a.MemoryPercent} {
+		if value <= 0 || value > 100 {
+			problems = append(problems, fmt.Sprintf("%s must be above 0 and at most 100, got %g", name, value))
+		}
+	}
+	if !containsString([]string{"5m", "10m", "30m", "1h"}, a.Window) {
+		problems = append(problems, fmt.Sprintf("window must be 5m, 10m, 30m or 1h, got %q", a.Window))
+	}
+	for _, email := range a.Emails {
+		if _, err := mail.ParseAddress(email); err != nil {
+			problems = append(problems, fmt.Sprintf("%q is not an email address", email))
+		}
+	}
+	if a.PlainSlackURL != "" {
+		problems = append(problems, "slackUrl is a credential; move it to the alertsSlackUrl secret (pulumi config set --secret alertsSlackUrl ...)")
+	}
+	// A slackChannel without its secret is reported by checkSecrets.
+	if a.HasSlackURL && a.SlackChannel == "" {
+		problems = append(problems, "the alertsSlackUrl secret needs a slackChannel")
+	}
+	if len(a.Emails) == 0 && a.SlackChannel == "" {
+		problems = append(problems, "set emails or a slack channel to alert")
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("alerts: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+func (a alertsSpec) targets() *digitalocean.MonitorAlertAlertsArgs {
+	var targets = &digitalocean.MonitorAlertAlertsArgs{
+		Emails: pulumi.ToStringArray(a.Emails),
+	}
+	if a.HasSlackURL {
+		targets.Slacks = digitalocean.MonitorAlertAlertsSlackArray{
+			digitalocean.MonitorAlertAlertsSlackArgs{
+				Channel: pulumi.String(a.SlackChannel),
+				Url:     a.SlackURL,
+			},
+		}
+	}
+	return targets
+}
+
+// createAlerts creates the CPU and memory alerts for the given droplets.
+func createAlerts(ctx *pulumi.Context, spec alertsSpec, dropletIds pulumi.StringArray, opts ...pulumi.ResourceOption) error {
+	fmt.Println("Creating monitoring alerts.")
+	var thresholds = []struct {
+		name, metric, description string
+		value                     float64
+	}{
+		{"rocket-cpu-alert", "v1/insights/droplet/cpu", "rocket CPU usage is high", spec.CPUPercent},
+		{"rocket-memory-alert", "v1/insights/droplet/memory_utilization_percent", "rocket memory usage is high", spec.MemoryPercent},
+	}
+	var ids = pulumi.StringArray{}
+	for _, t := range thresholds {
+		var alert, err = digitalocean.NewMonitorAlert(ctx, t.name, &digitalocean.MonitorAlertArgs{
+			Alerts:      spec.targets(),
+			Compare:     pulumi.String("GreaterThan"),
+			Description: pulumi.String(t.description),
+			Entities:    dropletIds,
+			Type:        pulumi.String(t.metric),
+			Value:       pulumi.Float64(t.value),
+			Window:      pulumi.String(spec.Window),
+		}, opts...)
+		if err != nil {
+			return err
+		}
+		ids = append(ids, alert.ID().ToStringOutput())
+	}
+	ctx.Export("alert-ids", ids)
+	return nil
+}
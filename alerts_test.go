@@ -0,0 +1,42 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAlertsSlackURLStaysSecret(t *testing.T) {
+	var m = &mocks{}
+	if err := runDeploy(t, m, map[string]string{
+		"alerts":         `{"enabled": true, "slackChannel": "#ops"}`,
+		"alertsSlackUrl": "https://hooks.slack.com/services/T0/B0/secret",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	var alerts = m.created("digitalocean:index/monitorAlert:MonitorAlert")
+	if len(alerts) != 2 {
+		t.Fatalf("want the CPU and memory alerts, got %d", len(alerts))
+	}
+	for name, inputs := range alerts {
+		var slacks = inputs["alerts"].ObjectValue()["slacks"].ArrayValue()
+		if len(slacks) != 1 {
+			t.Fatalf("%s: want one slack target, got %d", name, len(slacks))
+		}
+		if url := slacks[0].ObjectValue()["url"]; !url.IsSecret() {
+			t.Errorf("%s: slack url %v is not a secret", name, url)
+		}
+	}
+}
+
+func TestAlertsRejectPlainSlackURL(t *testing.T) {
+	var m = &mocks{}
+	var err = runDeploy(t, m, map[string]string{
+		"alerts": `{"enabled": true, "slackChannel": "#ops", "slackUrl": "https://hooks.slack.com/services/T0/B0/secret"}`,
+	})
+	if err == nil || !strings.Contains(err.Error(), "alertsSlackUrl secret") {
+		t.Fatalf("want an error pointing at the alertsSlackUrl secret, got %v", err)
+	}
+	if len(m.resources) != 0 {
+		t.Errorf("registered %d resources before failing", len(m.resources))
+	}
+}
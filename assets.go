@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/pulumi/pulumi-digitalocean/sdk/v4/go/digitalocean"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+// staticAssetsSpec serves static assets from a Spaces bucket through
+// DigitalOcean's CDN, on Subdomain of the site's domain. Creating the bucket
+// needs the digitalocean:spacesAccessId and spacesSecretKey provider config.
+type staticAssetsSpec struct {
+	Enabled   bool   `json:"enabled"`
+	Bucket    string `json:"bucket"`
+	Region    string `json:"region"`
+	Subdomain string `json:"subdomain"`
+	// Ttl is how long the CDN caches an asset, in seconds.
+	Ttl int `json:"ttl"`
+}
+
+var defaultStaticAssets = staticAssetsSpec{
+	Region:    "nyc3",
+	Subdomain: "assets",
+	Ttl:       3600,
+}
+
+var (
+	bucketNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{1,61}[a-z0-9]$`)
+	spacesRegions     = []string{"nyc3", "ams3", "sfo2", "sfo3", "sgp1", "fra1"}
+	cdnTtls           = []int{60, 600, 3600, 86400, 604800}
+)
+
+func (s staticAssetsSpec) validate() error {
+	if !s.Enabled {
+		return nil
+	}
+	if !bucketNamePattern.MatchString(s.Bucket) {
+		return fmt.Errorf("staticAssets.bucket %q must be 3 to 63 lowercase letters, digits and dashes", s.Bucket)
+	}
+	if !containsString(spacesRegions, s.Region) {
+		return fmt.Errorf("staticAssets.region must be a Spaces region (%v), got %q", spacesRegions, s.Region)
+	}
+	if !dnsLabelPattern.MatchString(s.Subdomain) || s.Subdomain == siteSubdomain {
+		return fmt.Errorf("staticAssets.subdomain %q is not a DNS label other than pulumi", s.Subdomain)
+	}
+	for _, ttl := range cdnTtls {
+		if s.Ttl == ttl {
+			return nil
+		}
+	}
+	return fmt.Errorf("staticAssets.ttl must be one of %v, got %d", cdnTtls, s.Ttl)
+}
+
+// createStaticAssets creates the bucket, a CDN endpoint in front of it served
+// with the certificate covering the subdomain, and the subdomain's CNAME.
+func createStaticAssets(ctx *pulumi.Context, spec staticAssetsSpec, domain *digitalocean.LookupDomainResult, certs map[string]*digitalocean.Certificate, ttl int, opts ...pulumi.ResourceOption) (*digitalocean.SpacesBucket, error) {
+	var hostname = spec.Subdomain + "." + domain.Name
+	var cert, ok = certificateFor(certs, hostname)
+	if !ok {
+		return nil, fmt.Errorf("staticAssets: no certificate covers domain %q", hostname)
+	}
+	fmt.Println("Creating Spaces bucket and CDN endpoint.")
+	var bucket, err = digitalocean.NewSpacesBucket(ctx, "assets-bucket", &digitalocean.SpacesBucketArgs{
+		Name:   pulumi.String(spec.Bucket),
+		Region: pulumi.String(spec.Region),
+		Acl:    pulumi.String("public-read"),
+	}, opts...)
+	if err != nil {
+		return nil, err
+	}
+	cdn, err := digitalocean.NewCdn(ctx, "assets-cdn", &digitalocean.CdnArgs{
+		Origin:          bucket.BucketDomainName,
+		CustomDomain:    pulumi.String(hostname),
+		CertificateName: cert.Name,
+		Ttl:             pulumi.Int(spec.Ttl),
+	}, opts...)
+	if err != nil {
+		return nil, err
+	}
+	_, err = digitalocean.NewDnsRecord(ctx, "assets-dns-cname", &digitalocean.DnsRecordArgs{
+		Domain: pulumi.String(domain.Id),
+		Name:   pulumi.String(spec.Subdomain),
+		Type:   pulumi.String("CNAME"),
+		Ttl:    pulumi.Int(ttl),
+		Value:  pulumi.Sprintf("%s.", cdn.Endpoint),
+	}, opts...)
+	if err != nil {
+		return nil, err
+	}
+	ctx.Export("cdn-endpoint", cdn.Endpoint)
+	ctx.Export("assets-url", pulumi.String("https://"+hostname))
+	return bucket, nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/pulumi/pulumi-command/sdk/go/command/local"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+// Blue-green deploys keep each slot's droplets under their own resource
+// names. Switching activeSlot declares a fresh set of droplets: they are
+// created, provisioned and checked, then the load balancer is moved onto
+// them, and only then, at the end of the update, does Pulumi delete the old
+// slot's droplets, which are no longer declared. Both slots run, and are
+// billed, for the length of that update.
+
+var deploySlots = []string{"blue", "green"}
+
+// slotSuffix tells the green slot's resources apart. Blue keeps the names
+// resources had before blue-green deploys existed.
+func slotSuffix(slot string) string {
+	if slot == "green" {
+		return "-green"
+	}
+	return ""
+}
+
+// cutoverCheckScript polls the droplet's service directly from this machine
+// for up to a minute.
+func cutoverCheckScript(url string) string {
+	return fmt.Sprintf(`for i in $(seq 1 30); do
+	if curl -sf -o /dev/null --max-time 2 '%[1]s'; then
+		echo "%[1]s is healthy"
+		exit 0
+	fi
+	sleep 2
+done
+echo "%[1]s never became healthy; keeping traffic on the old droplets" >&2
+exit 1`, url)
+}
+
+// gateCutover checks, from outside the droplet, that it serves address's
+// healthPath once healthy has run. The load balancer only moves onto the
+// droplet once it passes.
+func gateCutover(ctx *pulumi.Context, name string, address pulumi.StringOutput, healthPath string, healthy pulumi.Resource, steps *provisioningSteps, opts ...pulumi.ResourceOption) (*local.Command, error) {
+	fmt.Println("Checking the new droplet before the cutover.")
+	var url = pulumi.Sprintf("http://%s%s", address, healthPath)
+	var cmdResult, err = local.NewCommand(ctx, name, &local.CommandArgs{
+		Create: url.ApplyT(cutoverCheckScript).(pulumi.StringOutput),
+	}, append(opts, pulumi.DependsOn([]pulumi.Resource{healthy}))...)
+	if err != nil {
+		return nil, err
+	}
+	outputLocalCmd(steps, name, cmdResult, healthy)
+	return cmdResult, nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pulumi/pulumi-command/sdk/go/command/local"
+	"github.com/pulumi/pulumi-digitalocean/sdk/v4/go/digitalocean"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+var registryNamePattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+// buildImageScript builds and pushes the image, then prints the digest the
+// registry stored it under.
+const buildImageScript = `set -e
+doctl registry login
+docker build -t "$IMAGE:$TAG" "$BUILD_CONTEXT"
+docker push "$IMAGE:$TAG"
+docker inspect --format '{{range .RepoDigests}}{{println .}}{{end}}' "$IMAGE:$TAG" | grep "^$IMAGE@" | head -n 1 | cut -d@ -f2`
+
+// registryImage is where image is pushed in the named registry.
+func registryImage(registry, image string) string {
+	return "registry.digitalocean.com/" + registry + "/" + path.Base(image)
+}
+
+// buildAndPushImage pushes a fresh build of buildContext to the container
+// registry on every deploy. It returns the repository pushed to and the
+// digest, so the unit can pull that exact build rather than whatever the tag
+// points at by then.
+func buildAndPushImage(ctx *pulumi.Context, registryName, image string, imageTag pulumi.StringOutput, buildContext string) (string, pulumi.StringOutput, error) {
+	fmt.Println("Building and pushing the container image.")
+	var registry, err = digitalocean.NewContainerRegistry(ctx, "rocket-registry", &digitalocean.ContainerRegistryArgs{
+		Name:                 pulumi.String(registryName),
+		SubscriptionTierSlug: pulumi.String("starter"),
+	})
+	if err != nil {
+		return "", pulumi.StringOutput{}, err
+	}
+	var repo = registryImage(registryName, image)
+	var tag = imageTag.ApplyT(func(tag string) string {
+		if tag == "" {
+			return "latest"
+		}
+		return tag
+	}).(pulumi.StringOutput)
+	build, err := local.NewCommand(ctx, "build-image", &local.CommandArgs{
+		Create: pulumi.String(buildImageScript),
+		Environment: pulumi.StringMap{
+			"IMAGE":         pulumi.String(repo),
+			"TAG":           tag,
+			"BUILD_CONTEXT": pulumi.String(buildContext),
+		},
+		Triggers: pulumi.Array{pulumi.String(strconv.FormatInt(time.Now().UnixNano(), 10))},
+	}, pulumi.DependsOn([]pulumi.Resource{registry}))
+	if err != nil {
+		return "", pulumi.StringOutput{}, err
+	}
+	var digest = build.Stdout.ApplyT(func(out string) (string, error) {
+		var digest = strings.TrimSpace(out)
+		if !imageDigestPattern.MatchString(digest) {
+			return "", fmt.Errorf("the pushed image has no digest in %s, got %q", repo, digest)
+		}
+		return digest, nil
+	}).(pulumi.StringOutput)
+	ctx.Export("image-ref", pulumi.Sprintf("%s@%s", repo, digest))
+	return repo, digest, nil
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pulumi/pulumi-command/sdk/go/command/remote"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+const (
+	caddyfilePath = "/etc/caddy/Caddyfile"
+	caddyUnitPath = "/etc/systemd/system/caddy.service"
+)
+
+// Redirects are disabled so Caddy only binds :443 and leaves :80 to the app;
+// certificates are obtained through the TLS-ALPN challenge instead.
+func renderCaddyfile(hostname string, targetPort int, http2, http3 bool) string {
+	return fmt.Sprintf(`{
+	auto_https disable_redirects
+	servers {
+		protocols %s
+	}
+}
+
+%s {
+	reverse_proxy localhost:%d
+}
+`, strings.Join(caddyProtocols(http2, http3), " "), hostname, targetPort)
+}
+
+func caddyProtocols(http2, http3 bool) []string {
+	var protocols = []string{"h1"}
+	if http2 {
+		protocols = append(protocols, "h2")
+	}
+	if http3 {
+		protocols = append(protocols, "h3")
+	}
+	return protocols
+}
+
+func renderCaddyUnit() string {
+	return `[Unit]
+Description = "Caddy TLS Proxy"
+After=docker.service
+Requires=docker.service
+
+[Service]
+ExecStartPre=-/usr/bin/docker rm -f caddy
+ExecStart=/usr/bin/docker run --name caddy --network host -v /etc/caddy:/etc/caddy -v caddy_data:/data caddy:2
+Restart=always
+
+[Install]
+WantedBy=multi-user.target
+`
+}
+
+// writeRenderedFile stores generated content at a stable local path so that
+// CopyFile sees the same LocalPath across runs.
+func writeRenderedFile(name, content string) (string, error) {
+	var dir = filepath.Join(os.TempDir(), "rocket-deploy")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+	var path = filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// privateRenderDir holds rendered files that carry secrets, such as the unit
+// with secretEnvironment or the database URL. Its path is stable, so
+// CopyFile's LocalPath doesn't change between runs, but only its owner can
+// read it.
+func privateRenderDir() (string, error) {
+	var dir = filepath.Join(os.TempDir(), fmt.Sprintf("rocket-deploy-%d", os.Getuid()))
+	if err := os.Mkdir(dir, 0o700); err != nil && !os.IsExist(err) {
+		return "", err
+	}
+	// Lstat, so that a symlink planted in the shared temp dir is refused.
+	var info, err = os.Lstat(dir)
+	if err != nil {
+		return "", err
+	}
+	if !info.IsDir() || info.Mode().Perm() != 0o700 {
+		return "", fmt.Errorf("%s must be a directory only its owner can access", dir)
+	}
+	return dir, nil
+}
+
+// writeSecretFile is writeRenderedFile for content that carries secrets: the
+// file is readable only by the current user, in privateRenderDir.
+func writeSecretFile(name, content string) (string, error) {
+	var dir, err = privateRenderDir()
+	if err != nil {
+		return "", err
+	}
+	var path = filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		return "", err
+	}
+	// WriteFile keeps the mode of a file that already exists.
+	return path, os.Chmod(path, 0o600)
+}
+
+// removeAfterCopy deletes the local file once copied has read it, which is when
+// its ID resolves. A copy that is already up to date resolves right away.
+func removeAfterCopy(copied *remote.CopyFile, localPath pulumi.StringOutput) {
+	pulumi.All(copied.ID(), localPath).ApplyT(func(args []interface{}) error {
+		var err = os.Remove(args[1].(string))
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	})
+}
+
+func copyRenderedFile(ctx *pulumi.Context, name, content, remotePath string, conn remote.ConnectionInput, options commandOptions, prior pulumi.Resource) (*remote.CopyFile, error) {
+	var localPath, err = writeRenderedFile(name, content)
+	if err != nil {
+		return nil, err
+	}
+	var deps = []pulumi.Resource{prior}
+	var opts = options.resourceOpts(pulumi.DependsOn(deps))
+	return remote.NewCopyFile(ctx, options.name("copy-"+name), &remote.CopyFileArgs{
+		Connection: conn,
+		LocalPath:  pulumi.String(localPath),
+		RemotePath: pulumi.String(remotePath),
+		Triggers:   pulumi.Array{pulumi.String(content)},
+	}, opts...)
+}
+
+func provisionCaddy(ctx *pulumi.Context, conn remote.ConnectionInput, options commandOptions, hostname string, targetPort int, http2, http3 bool, prior pulumi.Resource) (*remote.Command, error) {
+	fmt.Println("Provisioning Caddy.")
+	var mkdir, err = chainCommand(ctx, "create-caddy-dir", "mkdir -p /etc/caddy", conn, options, prior)
+	if err != nil {
+		return nil, err
+	}
+	caddyfile, err := copyRenderedFile(ctx, "Caddyfile", renderCaddyfile(hostname, targetPort, http2, http3), caddyfilePath, conn, options, mkdir)
+	if err != nil {
+		return nil, err
+	}
+	caddyUnit, err := copyRenderedFile(ctx, "caddy.service", renderCaddyUnit(), caddyUnitPath, conn, options, caddyfile)
+	if err != nil {
+		return nil, err
+	}
+	// Without a protocol, ufw opens both tcp and the udp port HTTP/3 needs.
+	openFirewall, err := chainCommand(ctx, "open-caddy-firewall", ufwAllowCommand(443), conn, options, caddyUnit)
+	if err != nil {
+		return nil, err
+	}
+	return chainCommand(ctx, "start-caddy", "systemctl daemon-reload && systemctl enable --now caddy.service", conn, options, openFirewall)
+}
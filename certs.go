@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/pulumi/pulumi-digitalocean/sdk/v4/go/digitalocean"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+// certificateSpec is a Let's Encrypt certificate for one or more domains.
+// A wildcard such as *.example.com only covers subdomains, so it must be
+// listed together with its apex.
+type certificateSpec struct {
+	Name    string   `json:"name"`
+	Domains []string `json:"domains"`
+}
+
+var domainPattern = regexp.MustCompile(`^([a-z0-9]([a-z0-9-]*[a-z0-9])?\.)+[a-z]{2,}$`)
+
+func (c certificateSpec) validate() error {
+	if c.Name == "" || len(c.Domains) == 0 {
+		return fmt.Errorf("each certificate needs a name and at least one domain")
+	}
+	for _, domain := range c.Domains {
+		var apex = strings.TrimPrefix(domain, "*.")
+		if !domainPattern.MatchString(apex) {
+			return fmt.Errorf("certificate %s: %q is not a domain name or wildcard", c.Name, domain)
+		}
+		if apex != domain && !containsString(c.Domains, apex) {
+			return fmt.Errorf("certificate %s: wildcard %q must be listed together with %q", c.Name, domain, apex)
+		}
+	}
+	return nil
+}
+
+type httpsRuleSpec struct {
+	Domain    string `json:"domain"`
+	EntryPort int    `json:"entryPort"`
+}
+
+// httpsRule is an https forwarding rule paired with the certificate that
+// covers its domain.
+type httpsRule struct {
+	Domain    string
+	EntryPort int
+	Cert      *digitalocean.Certificate
+}
+
+// createCertificates returns the certificates by the domains they cover, and
+// exports when each one expires and its fingerprint, for monitoring.
+func createCertificates(ctx *pulumi.Context, deadline context.Context, specs []certificateSpec, reuse, checkReachable bool, parentOpts ...pulumi.ResourceOption) (map[string]*digitalocean.Certificate, error) {
+	var certs = map[string]*digitalocean.Certificate{}
+	var summary = pulumi.Map{}
+	for _, spec := range specs {
+		if checkReachable {
+			for _, domain := range spec.Domains {
+				warnIfUnreachable(ctx, deadline, domain)
+			}
+		}
+		fmt.Printf("Creating Certificate %s.\n", spec.Name)
+		var domains = pulumi.StringArray{}
+		for _, domain := range spec.Domains {
+			domains = append(domains, pulumi.String(domain))
+		}
+		var args = &digitalocean.CertificateArgs{
+			Domains: domains,
+			Type:    pulumi.String("lets_encrypt"),
+		}
+		var opts = append([]pulumi.ResourceOption{}, parentOpts...)
+		if reuse {
+			// A fixed name lets the next deploy find this certificate again.
+			args.Name = pulumi.String(spec.Name)
+			var existingId, err = findReusableCertificate(ctx, spec)
+			if err != nil {
+				return nil, err
+			}
+			if existingId != "" {
+				opts = append(opts, pulumi.Import(pulumi.ID(existingId)))
+			}
+		}
+		var cert, err = digitalocean.NewCertificate(ctx, spec.Name, args, opts...)
+		if err != nil {
+			return nil, err
+		}
+		for _, domain := range spec.Domains {
+			certs[domain] = cert
+		}
+		summary[spec.Name] = pulumi.Map{
+			"notAfter":        cert.NotAfter,
+			"sha1Fingerprint": cert.Sha1Fingerprint,
+		}
+	}
+	ctx.Export("certificates", summary)
+	return certs, nil
+}
+
+// certificateFor returns the certificate covering domain, either by name or
+// through a wildcard for its parent domain.
+func certificateFor(certs map[string]*digitalocean.Certificate, domain string) (*digitalocean.Certificate, bool) {
+	for _, name := range coveringNames(domain) {
+		if cert, ok := certs[name]; ok {
+			return cert, true
+		}
+	}
+	return nil, false
+}
+
+// coveringNames are the certificate domains that cover domain: the domain
+// itself and the wildcard for its parent.
+func coveringNames(domain string) []string {
+	if i := strings.Index(domain, "."); i >= 0 {
+		return []string{domain, "*" + domain[i:]}
+	}
+	return []string{domain}
+}
+
+// certificatesCover reports whether any of the configured certificates
+// covers domain, before the certificates themselves exist.
+func certificatesCover(specs []certificateSpec, domain string) bool {
+	for _, spec := range specs {
+		for _, name := range coveringNames(domain) {
+			if containsString(spec.Domains, name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// warnIfUnreachable checks that a domain resolves and answers on port 80,
+// which Let's Encrypt's HTTP-01 validation needs. On a first deploy neither
+// the DNS record nor the LB exist yet, so this only ever warns.
+func warnIfUnreachable(ctx *pulumi.Context, deadline context.Context, domain string) {
+	if strings.HasPrefix(domain, "*.") {
+		return
+	}
+	var client = &http.Client{Timeout: 5 * time.Second}
+	var _, err = net.DefaultResolver.LookupHost(deadline, domain)
+	if err == nil {
+		var req *http.Request
+		req, err = http.NewRequestWithContext(deadline, http.MethodGet, "http://"+domain+"/", nil)
+		if err == nil {
+			var resp *http.Response
+			resp, err = client.Do(req)
+			if err == nil {
+				resp.Body.Close()
+				return
+			}
+		}
+	}
+	ctx.Log.Warn(fmt.Sprintf("%s is not reachable on port 80 yet (%v); its Let's Encrypt certificate may stay pending until it is", domain, err), nil)
+}
+
+// findReusableCertificate looks for an already issued certificate with the
+// spec's name, so that it can be adopted instead of requesting a new one from
+// Let's Encrypt and burning through its weekly issuance limit. Only a
+// not-found lookup means there is nothing to reuse; any other failure is
+// returned rather than requesting a fresh certificate.
+func findReusableCertificate(ctx *pulumi.Context, spec certificateSpec) (string, error) {
+	var existing, err = digitalocean.LookupCertificate(ctx, &digitalocean.LookupCertificateArgs{
+		Name: spec.Name,
+	})
+	if err != nil {
+		if isNotFound(err) {
+			return "", nil
+		}
+		return "", fmt.Errorf("looking up certificate %q: %w", spec.Name, err)
+	}
+	if existing == nil {
+		return "", nil
+	}
+	if !sameDomains(existing.Domains, spec.Domains) {
+		return "", fmt.Errorf("certificate %q already exists for %v, not %v; rename it or remove the old one",
+			spec.Name, existing.Domains, spec.Domains)
+	}
+	ctx.Log.Info(fmt.Sprintf("reusing existing certificate %q (%s) for %v", spec.Name, existing.Id, spec.Domains), nil)
+	return existing.Id, nil
+}
+
+func sameDomains(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	var want = map[string]bool{}
+	for _, domain := range b {
+		want[domain] = true
+	}
+	for _, domain := range a {
+		if !want[domain] {
+			return false
+		}
+	}
+	return true
+}
+
+// resolveHttpsRules matches every rule to the certificate serving its domain,
+// reporting all rules that can't be matched at once.
+func resolveHttpsRules(specs []httpsRuleSpec, certs map[string]*digitalocean.Certificate) ([]httpsRule, error) {
+	var rules []httpsRule
+	var problems []string
+	var seenPorts = map[int]string{}
+	for _, spec := range specs {
+		var cert, ok = certificateFor(certs, spec.Domain)
+		if !ok {
+			problems = append(problems, fmt.Sprintf("no certificate covers domain %q", spec.Domain))
+			continue
+		}
+		if other, dup := seenPorts[spec.EntryPort]; dup {
+			problems = append(problems, fmt.Sprintf("domains %q and %q both use entry port %d", other, spec.Domain, spec.EntryPort))
+			continue
+		}
+		seenPorts[spec.EntryPort] = spec.Domain
+		rules = append(rules, httpsRule{
+			Domain:    spec.Domain,
+			EntryPort: spec.EntryPort,
+			Cert:      cert,
+		})
+	}
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("invalid https rules: %s", strings.Join(problems, "; "))
+	}
+	return rules, nil
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pulumi/pulumi-command/sdk/go/command/local"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+// exportDeployChanged records the time of the last change in a marker command
+// that only re-runs when one of its triggers does. If the recorded time is
+// newer than the start of this run, something was (re)created during it.
+func exportDeployChanged(ctx *pulumi.Context, triggers pulumi.Array) error {
+	var runStart = time.Now().Unix()
+	var marker, err = local.NewCommand(ctx, "deploy-changed-marker", &local.CommandArgs{
+		Create:   pulumi.String("date +%s"),
+		Triggers: triggers,
+	})
+	if err != nil {
+		return err
+	}
+	var changed = marker.Stdout.ApplyT(func(stdout string) (bool, error) {
+		var changedAt, err = strconv.ParseInt(strings.TrimSpace(stdout), 10, 64)
+		if err != nil {
+			return false, err
+		}
+		var changed = changedAt >= runStart
+		ctx.Log.Info("deploy changed infrastructure: "+strconv.FormatBool(changed), nil)
+		return changed, nil
+	}).(pulumi.BoolOutput)
+	ctx.Export("changed", changed)
+	return nil
+}
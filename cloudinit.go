@@ -0,0 +1,23 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+)
+
+// renderCloudInit returns cloud-config user data that installs the unit at
+// unitPath and starts it on first boot, so the droplet provisions itself
+// without anything running over SSH. The unit is base64 encoded so its
+// contents never need YAML escaping.
+func renderCloudInit(unitPath, unitFile, unit string) string {
+	return fmt.Sprintf(`#cloud-config
+write_files:
+  - path: %[1]s
+    permissions: '0644'
+    encoding: b64
+    content: %[3]s
+runcmd:
+  - systemctl daemon-reload
+  - systemctl enable --now %[2]s
+`, unitPath, unitFile, base64.StdEncoding.EncodeToString([]byte(unit)))
+}
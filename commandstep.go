@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pulumi/pulumi-command/sdk/go/command/remote"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+// CommandStep is one remote provisioning command.
+type CommandStep struct {
+	Name   string `json:"name"`
+	Script string `json:"script"`
+	// Dir is the remote working directory; empty keeps the login directory.
+	Dir string `json:"dir"`
+	// Env is exported in the script itself rather than passed through
+	// CommandArgs.Environment, which sshd drops unless AcceptEnv allows it.
+	Env map[string]string `json:"env"`
+	// TimeoutSeconds overrides commandTimeoutSeconds for this step.
+	TimeoutSeconds int `json:"timeoutSeconds"`
+}
+
+func (s CommandStep) validate() error {
+	for key := range s.Env {
+		if !envVarPattern.MatchString(key) {
+			return fmt.Errorf("step %q: %q is not a valid variable name", s.Name, key)
+		}
+	}
+	if s.TimeoutSeconds < 0 {
+		return fmt.Errorf("step %q: timeoutSeconds must not be negative", s.Name)
+	}
+	return nil
+}
+
+// command prefixes the script with its environment and directory. Keys are
+// sorted so that the same step always renders the same command and doesn't
+// re-run needlessly.
+func (s CommandStep) command() string {
+	var keys = make([]string, 0, len(s.Env))
+	for key := range s.Env {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var lines []string
+	for _, key := range keys {
+		lines = append(lines, fmt.Sprintf("export %s=%s", key, shellQuote(s.Env[key])))
+	}
+	if s.Dir != "" {
+		lines = append(lines, "cd "+shellQuote(s.Dir))
+	}
+	return strings.Join(append(lines, s.Script), "\n")
+}
+
+func shellQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
+
+func chainStep(ctx *pulumi.Context, step CommandStep, conn remote.ConnectionInput, options commandOptions, prior pulumi.Resource) (*remote.Command, error) {
+	if err := step.validate(); err != nil {
+		return nil, err
+	}
+	if step.TimeoutSeconds > 0 {
+		options.Timeout = time.Duration(step.TimeoutSeconds) * time.Second
+	}
+	return chainCommand(ctx, step.Name, step.command(), conn, options, prior)
+}
+
+// commandOptions control how every remote provisioning command runs.
+type commandOptions struct {
+	// RetryCount is how many attempts a command gets; 1 or less runs it once.
+	RetryCount int
+	// RetryDelay is the pause before the first retry, doubling after each.
+	RetryDelay time.Duration
+	// Timeout kills an attempt that runs longer, which then fails with
+	// status 124 like any other failed attempt. 0 lets it run indefinitely.
+	Timeout time.Duration
+	// DeployTimeout caps Timeout so that every attempt, retries included,
+	// fits within deployTimeoutMinutes. 0 leaves Timeout as is.
+	DeployTimeout time.Duration
+	// Resource options apply to each command created, e.g. its parent.
+	Resource []pulumi.ResourceOption
+	// Suffix tells one host's resources apart from another's. The first host
+	// has none, so its resource names predate multiple droplets.
+	Suffix string
+	// Triggers re-run each command whenever one of them changes, since a
+	// command otherwise only re-runs when its own script does.
+	Triggers pulumi.Array
+	// Sudo runs privileged commands through sudo, for a non-root SSH user.
+	Sudo bool
+	// Steps records each command created, for the provisioningResults
+	// output. Nil records nothing.
+	Steps *provisioningSteps
+}
+
+// privileged runs cmd as root: as is when connected as root, otherwise
+// through sudo. Wrapping the whole script in bash keeps every command of a
+// compound one privileged, not just the first.
+func (o commandOptions) privileged(cmd string) string {
+	if !o.Sudo {
+		return cmd
+	}
+	return "sudo -n bash -c " + shellQuote(cmd)
+}
+
+// attemptTimeout is Timeout, capped to an equal share of the deploy timeout
+// for each attempt.
+func (o commandOptions) attemptTimeout() time.Duration {
+	if o.DeployTimeout <= 0 {
+		return o.Timeout
+	}
+	var attempts = o.RetryCount
+	if attempts < 1 {
+		attempts = 1
+	}
+	var limit = o.DeployTimeout / time.Duration(attempts)
+	if o.Timeout <= 0 || o.Timeout > limit {
+		return limit
+	}
+	return o.Timeout
+}
+
+// name returns the resource (or export) name base takes on this host.
+func (o commandOptions) name(base string) string {
+	return base + o.Suffix
+}
+
+// wrap runs cmd in a retry loop on the host. A command that fails every
+// attempt still exits with its last status, so it fails the chain. Commands
+// without retries or a timeout are left untouched, so enabling either later
+// re-runs them once.
+func (o commandOptions) wrap(cmd string) string {
+	// Each attempt runs in a bash of its own. Bash ignores set -e in an
+	// until condition, even within a subshell, so a script that relies on
+	// errexit would otherwise carry on past a failed command and succeed.
+	var attempt = "bash -c " + shellQuote(cmd)
+	var timeout = o.attemptTimeout()
+	if timeout > 0 {
+		// -k follows up with SIGKILL for a command that ignores SIGTERM.
+		attempt = fmt.Sprintf("timeout -k 10 %d %s", int(timeout.Seconds()), attempt)
+	}
+	if o.RetryCount <= 1 {
+		if timeout > 0 {
+			return attempt
+		}
+		return cmd
+	}
+	return fmt.Sprintf(`attempt=1
+delay=%[2]d
+until %[3]s; do
+	status=$?
+	if [ "$attempt" -ge %[1]d ]; then
+		echo "giving up after $attempt attempts" >&2
+		exit "$status"
+	fi
+	echo "attempt $attempt failed with status $status; retrying in ${delay}s" >&2
+	sleep "$delay"
+	attempt=$((attempt + 1))
+	delay=$((delay * 2))
+done`, o.RetryCount, int(o.RetryDelay.Seconds()), attempt)
+}
+
+// resourceOpts returns a fresh slice so callers can append without sharing
+// the backing array.
+func (o commandOptions) resourceOpts(extra ...pulumi.ResourceOption) []pulumi.ResourceOption {
+	return append(append([]pulumi.ResourceOption{}, o.Resource...), extra...)
+}
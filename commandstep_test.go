@@ -0,0 +1,61 @@
+package main
+
+import (
+	"os/exec"
+	"testing"
+	"time"
+)
+
+func TestCommandStepCommand(t *testing.T) {
+	var step = CommandStep{
+		Script: `echo "$GREETING"`,
+		Dir:    "/srv/my app",
+		Env:    map[string]string{"RELEASE": "v1", "GREETING": "it's $HOME"},
+	}
+	var want = `export GREETING='it'\''s $HOME'
+export RELEASE='v1'
+cd '/srv/my app'
+echo "$GREETING"`
+	if got := step.command(); got != want {
+		t.Errorf("command() =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestCommandStepCommandQuotesValuesForTheShell(t *testing.T) {
+	var bash, err = exec.LookPath("bash")
+	if err != nil {
+		t.Skip("bash is not installed")
+	}
+	var values = []string{"plain", "two words", "it's", `"quoted"`, "$HOME `id` $(id)", "a\nb", ""}
+	for _, value := range values {
+		var step = CommandStep{Script: `printf %s "$VALUE"`, Env: map[string]string{"VALUE": value}}
+		out, err := exec.Command(bash, "-c", step.command()).Output()
+		if err != nil {
+			t.Fatalf("running %q: %v", step.command(), err)
+		}
+		if string(out) != value {
+			t.Errorf("VALUE came through as %q, want %q", out, value)
+		}
+	}
+}
+
+func TestAttemptTimeoutFitsTheDeployTimeout(t *testing.T) {
+	var tests = []struct {
+		name    string
+		options commandOptions
+		want    time.Duration
+	}{
+		{"no deploy timeout", commandOptions{Timeout: time.Hour}, time.Hour},
+		{"no command timeout", commandOptions{DeployTimeout: 30 * time.Minute}, 30 * time.Minute},
+		{"shorter command timeout", commandOptions{Timeout: time.Minute, DeployTimeout: 30 * time.Minute}, time.Minute},
+		{"longer command timeout", commandOptions{Timeout: time.Hour, DeployTimeout: 30 * time.Minute}, 30 * time.Minute},
+		{"split across retries", commandOptions{RetryCount: 3, DeployTimeout: 30 * time.Minute}, 10 * time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.options.attemptTimeout(); got != tt.want {
+				t.Errorf("attemptTimeout() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
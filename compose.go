@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/pulumi/pulumi-command/sdk/go/command/remote"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+const composeTemplatePath = "docker-compose.yml.tmpl"
+
+// ComposeService is one service of the compose project. The app itself is
+// always the first; the "composeServices" config adds the rest.
+type ComposeService struct {
+	Name  string `json:"name"`
+	Image string `json:"image"`
+	// Ports are published as host:container, optionally with /tcp or /udp.
+	Ports       []string          `json:"ports"`
+	Environment map[string]string `json:"environment"`
+	User        string            `json:"user"`
+	ReadOnly    bool              `json:"readOnly"`
+	// StopSignal and StopGracePeriod carry the unit's drain behaviour over
+	// to the app's service.
+	StopSignal      string `json:"-"`
+	StopGracePeriod int    `json:"-"`
+}
+
+var composePortPattern = regexp.MustCompile(`^[0-9]{1,5}(:[0-9]{1,5})?(/(tcp|udp))?$`)
+
+func (s ComposeService) validate() error {
+	if !sidecarNamePattern.MatchString(s.Name) {
+		return fmt.Errorf("compose service name %q must be lowercase letters, digits and dashes", s.Name)
+	}
+	if s.Image == "" || strings.ContainsAny(s.Image, " '\"") {
+		return fmt.Errorf("compose service %s: image %q is not a valid image reference", s.Name, s.Image)
+	}
+	for _, port := range s.Ports {
+		if !composePortPattern.MatchString(port) {
+			return fmt.Errorf("compose service %s: port %q must look like 8080 or 80:8080/tcp", s.Name, port)
+		}
+	}
+	for key, value := range s.Environment {
+		if !envVarPattern.MatchString(key) {
+			return fmt.Errorf("compose service %s: %q is not a valid variable name", s.Name, key)
+		}
+		if strings.ContainsAny(value, "\"\n\\") {
+			return fmt.Errorf("compose service %s: the value of %s must not contain quotes, backslashes or newlines", s.Name, key)
+		}
+	}
+	if s.User != "" && !containerUserPattern.MatchString(s.User) {
+		return fmt.Errorf("compose service %s: user %q must be a user name or uid, optionally followed by :group", s.Name, s.User)
+	}
+	return nil
+}
+
+// EnvKeys lists Environment's keys in a stable order, so the rendered file
+// only changes when its values do.
+func (s ComposeService) EnvKeys() []string {
+	var keys = make([]string, 0, len(s.Environment))
+	for key := range s.Environment {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// EnvValue escapes $ so compose doesn't interpolate it.
+func (s ComposeService) EnvValue(key string) string {
+	return strings.ReplaceAll(s.Environment[key], "$", "$$")
+}
+
+func validateComposeServices(appName string, services []ComposeService) error {
+	var seen = map[string]bool{appName: true}
+	for _, service := range services {
+		if err := service.validate(); err != nil {
+			return err
+		}
+		if seen[service.Name] {
+			return fmt.Errorf("composeServices: %q is used more than once, or by the app", service.Name)
+		}
+		seen[service.Name] = true
+	}
+	return nil
+}
+
+// appComposeService runs the app the way its systemd unit would.
+func appComposeService(params SystemdParams) ComposeService {
+	return ComposeService{
+		Name:            params.Name,
+		Image:           params.ImageRef(),
+		Ports:           []string{fmt.Sprintf("80:%d", params.ContainerPort)},
+		Environment:     params.Environment,
+		User:            params.User,
+		ReadOnly:        params.ReadOnly,
+		StopSignal:      "SIGINT",
+		StopGracePeriod: params.DrainTimeout,
+	}
+}
+
+func renderComposeFile(services []ComposeService) (string, error) {
+	var raw, err = os.ReadFile(composeTemplatePath)
+	if err != nil {
+		return "", err
+	}
+	tmpl, err := template.New(composeTemplatePath).Parse(string(raw))
+	if err != nil {
+		return "", err
+	}
+	var out bytes.Buffer
+	if err := tmpl.Execute(&out, struct{ Services []ComposeService }{services}); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
+
+// composeFile renders the compose file once the image tag and digest are
+// known, with the app first and extra after it.
+func composeFile(params SystemdParams, extra []ComposeService, imageTag, imageDigest pulumi.StringOutput, env pulumi.StringMap) pulumi.StringOutput {
+	return pulumi.All(imageTag, imageDigest, env.ToStringMapOutput()).ApplyT(func(args []interface{}) (string, error) {
+		var resolved, err = resolveSystemdParams(params, args[0].(string), args[1].(string), args[2].(map[string]string))
+		if err != nil {
+			return "", err
+		}
+		return renderComposeFile(append([]ComposeService{appComposeService(resolved)}, extra...))
+	}).(pulumi.StringOutput)
+}
+
+var composeEnvLinePattern = regexp.MustCompile(`^(\s+)([A-Za-z_][A-Za-z0-9_]*): "`)
+
+// redactComposeFile masks environment values whose name looks like it
+// carries a secret, as redactUnit does for the unit.
+func redactComposeFile(file string) string {
+	var lines = strings.Split(file, "\n")
+	for i, line := range lines {
+		var match = composeEnvLinePattern.FindStringSubmatch(line)
+		if match != nil && secretEnvPattern.MatchString(match[2]) {
+			lines[i] = fmt.Sprintf(`%s%s: "[redacted]"`, match[1], match[2])
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// composeDir holds the project's compose file on the host.
+func composeDir(params SystemdParams) string {
+	return "/opt/" + params.Name
+}
+
+func composeFilePath(params SystemdParams) string {
+	return composeDir(params) + "/docker-compose.yml"
+}
+
+// stagedComposePath is where the compose file is copied when connected as a
+// non-root user, who can't write to composeDir directly.
+func stagedComposePath(params SystemdParams) string {
+	return "/tmp/" + params.Name + "-docker-compose.yml"
+}
+
+// composeCommand runs a docker compose subcommand against the project.
+func composeCommand(params SystemdParams, subcommand string) string {
+	return fmt.Sprintf("docker compose -p %s -f %s %s", params.Name, composeFilePath(params), subcommand)
+}
+
+func copyComposeFile(ctx *pulumi.Context, conn remote.ConnectionInput, options commandOptions, params SystemdParams, file pulumi.StringOutput, hostReady pulumi.Resource) (*remote.CopyFile, error) {
+	fmt.Println("Copying compose file to droplet.")
+	var localPath = file.ApplyT(func(file string) (string, error) {
+		return writeSecretFile(params.Name+"-docker-compose.yml", file)
+	}).(pulumi.StringOutput)
+	var remotePath = stagedComposePath(params)
+	var prior = hostReady
+	// As root the file goes straight into place; compose-up installs the
+	// staged copy otherwise.
+	if !options.Sudo {
+		remotePath = composeFilePath(params)
+		var mkdir, err = chainCommand(ctx, "create-compose-dir", "mkdir -p "+composeDir(params), conn, options, hostReady)
+		if err != nil {
+			return nil, err
+		}
+		prior = mkdir
+	}
+	var deps = []pulumi.Resource{prior}
+	var opts = options.resourceOpts(pulumi.DependsOn(deps))
+	var res, err = remote.NewCopyFile(ctx, options.name("copy-compose-file"), &remote.CopyFileArgs{
+		Connection: conn,
+		LocalPath:  localPath,
+		RemotePath: pulumi.String(remotePath),
+		// LocalPath stays the same across runs, so re-copy on content changes.
+		Triggers: pulumi.Array{file},
+	}, opts...)
+	if err != nil {
+		return nil, err
+	}
+	removeAfterCopy(res, localPath)
+	return res, nil
+}
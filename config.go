@@ -0,0 +1,845 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi/config"
+)
+
+var envVarPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// dockerVersionPattern accepts apt versions such as 5:20.10.17~3-0~ubuntu-focal,
+// or an empty string to keep the image's preinstalled docker.
+var dockerVersionPattern = regexp.MustCompile(`^([0-9]+:)?[0-9A-Za-z.+~-]*$`)
+
+var pruneAgePattern = regexp.MustCompile(`^[0-9]+[smh]$`)
+
+var tagPattern = regexp.MustCompile(`^[A-Za-z0-9:_-]{1,255}$`)
+
+// digitalOceanRegions are the region slugs droplets can be created in.
+var digitalOceanRegions = []string{
+	"ams3", "blr1", "fra1", "lon1", "nyc1", "nyc2", "nyc3",
+	"sfo2", "sfo3", "sgp1", "syd1", "tor1",
+}
+
+var sshUserPattern = regexp.MustCompile(`^[a-z_][a-z0-9_-]*$`)
+
+var dnsLabelPattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+var dropletImagePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9.-]*$`)
+
+type appConfig struct {
+	SSHKeyName     string
+	PrivateKeyPath string
+	// PublicKey, or the file at PublicKeyPath, is uploaded as SSHKeyName
+	// instead of expecting that key to exist in the account already.
+	PublicKey     string
+	PublicKeyPath string
+	// SSHUser and SSHPort are how droplets are reached. UseSudo runs the
+	// privileged provisioning steps through sudo, for users other than root.
+	SSHUser string
+	SSHPort int
+	UseSudo bool
+	// PrivateKey holds the key itself when HasInlineKey is set, so it can be
+	// supplied as an encrypted secret instead of a file.
+	PrivateKey        pulumi.StringOutput
+	HasInlineKey      bool
+	Domain            string
+	Region            string
+	EnableCertificate bool
+	UseCaddy          bool
+	TargetPort        int
+	Size              string
+	DropletImage      string
+	ResizeInPlace     bool
+	Certificates      []certificateSpec
+	HttpsRules        []httpsRuleSpec
+	ReuseCertificates bool
+	Systemd           SystemdParams
+	EnvFilePath       string
+	EnvFileKeys       map[string]string
+	DropletCount      int
+	EgressCheckURL    string
+	DeployLock        bool
+	DeployLockTTL     time.Duration
+	ScanImage         bool
+	Scanner           string
+	ScanSeverity      string
+	DockerVersion     string
+	HealthPath        string
+	ImageTagFromGit   bool
+	ImagePrunePolicy  string
+	// ImagePruneOlderThan is a docker duration filter such as "72h".
+	ImagePruneOlderThan string
+	HTTP2               bool
+	HTTP3               bool
+	// CheckDomainReachable warns when a certificate domain can't be reached
+	// on port 80 before the certificate is requested.
+	CheckDomainReachable bool
+	Tags                 []string
+	DeployTimeout        time.Duration
+	LBHealthcheck        lbHealthcheckSpec
+	Project              projectSpec
+	Database             databaseSpec
+	Provider             string
+	SSHTarget            sshTarget
+	// SSHSourceAddresses are the CIDRs the cloud firewall accepts SSH from.
+	SSHSourceAddresses   []string
+	IntegrationTestPath  string
+	IntegrationTestToken pulumi.StringOutput
+	DeleteProtection     bool
+	DestroyConfirmation  string
+	RegistryAuth         registryAuthSpec
+	// BuildImage builds BuildContext and pushes it to the RegistryName
+	// container registry, instead of deploying an image pushed out-of-band.
+	BuildImage   bool
+	RegistryName string
+	BuildContext string
+	// ReservedIP gives the first droplet an address that outlives it, which
+	// the A record points at when there is no LB in front.
+	ReservedIP bool
+	// EnableIPv6 gives the droplet an IPv6 address and publishes it in an
+	// AAAA record.
+	EnableIPv6 bool
+	// EnableDNSAliases adds a CNAME to the A record for each DNSAliases name.
+	EnableDNSAliases bool
+	DNSAliases       []string
+	// RollbackDNS restores the previous A record when the site doesn't answer
+	// through the new one. It needs an authenticated doctl locally.
+	RollbackDNS bool
+	// CreateGoldenSnapshot snapshots the provisioned droplet and builds later
+	// droplets from that snapshot.
+	CreateGoldenSnapshot bool
+	// CustomSteps adds remote steps to the end of a provisioning phase.
+	CustomSteps map[string][]CommandStep
+	// CommandRetryCount and CommandRetryDelay retry flaky remote commands,
+	// such as those racing apt or sshd on a freshly booted droplet.
+	CommandRetryCount int
+	CommandRetryDelay time.Duration
+	// CommandTimeout bounds each attempt of a remote command, so one stuck
+	// on e.g. an apt lock fails the deploy instead of hanging it. 0 is no limit.
+	CommandTimeout time.Duration
+	BootTimeout    time.Duration
+	// PlanOnly emits the deploy plan and stops before creating anything.
+	PlanOnly bool
+	PlanFile string
+	// Provisioner is how the droplet gets the unit: "ssh" copies and starts
+	// it over SSH, "cloud-init" has the droplet do it at first boot.
+	Provisioner string
+	// DNSTTL is the TTL, in seconds, of the site's DNS records. It is kept
+	// low so a rebuilt droplet's new address reaches resolvers quickly.
+	DNSTTL int
+	// Runtime is how the host runs the app: "systemd" installs a unit for
+	// its container, "compose" runs it and ComposeServices as a compose
+	// project.
+	Runtime         string
+	ComposeServices []ComposeService
+	VPC             vpcSpec
+	// SecretEnvironment adds variables to the unit like "environment" does,
+	// but keeps the unit, and every output derived from it, secret. It is
+	// set with `pulumi config set --secret --path secretEnvironment.NAME`,
+	// and a name set in both takes its value from here.
+	SecretEnvironment map[string]string
+	LBStickySessions  lbStickySessionsSpec
+	// Backups turns on DigitalOcean's weekly droplet backups, which are billed
+	// at 20% of the droplet's price.
+	Backups bool
+	// SnapshotLabel, when set, snapshots the first droplet once provisioned.
+	// Changing it takes another snapshot; snapshots are billed by size.
+	SnapshotLabel string
+	// TailLogs exports the last TailLogLines lines of TailLogUnit's journal,
+	// or of the compose project's logs, after each deploy.
+	TailLogs     bool
+	TailLogLines int
+	TailLogUnit  string
+	// BlueGreen deploys to the ActiveSlot's droplets, blue or green. Switching
+	// slots brings up new droplets before retiring the old ones; see
+	// bluegreen.go.
+	BlueGreen  bool
+	ActiveSlot string
+	Alerts     alertsSpec
+	// ForwardingRules replaces the LB's default rules, port 80 plus one per
+	// httpsRules entry, when set.
+	ForwardingRules []forwardingRuleSpec
+	// ProxyProtocol has the LB prefix each connection with a PROXY protocol
+	// header carrying the client's address. The app must parse that header
+	// itself, since the unit publishes its port as is, and must also accept
+	// connections without one, like the health probe's.
+	ProxyProtocol bool
+	// SwapSizeMb adds a swap file of that size to each host before docker
+	// runs, so small droplets don't run out of memory. 0 adds none.
+	SwapSizeMb int
+	// PrivateKeyPassphrase decrypts a passphrase-protected private key. It is
+	// the empty string, still marked secret, when unset.
+	PrivateKeyPassphrase pulumi.StringOutput
+	StaticAssets         staticAssetsSpec
+	// Harden installs fail2ban on each host, banning an address for
+	// BanTimeSeconds after MaxRetry failed SSH logins.
+	Harden         bool
+	BanTimeSeconds int
+	MaxRetry       int
+	// HealthStatus is the status the on-host health probe expects from
+	// HealthPath, or 0 for any 2xx. It tries HealthAttempts times,
+	// HealthInterval seconds apart, before failing the deploy.
+	HealthStatus   int
+	HealthAttempts int
+	HealthInterval int
+	LBSizing       lbSizingSpec
+	// NamePrefix goes in front of resource names and the DNS subdomain. It
+	// is empty unless namePrefix or prefixNames is set, which keeps the names
+	// of stacks created before prefixing. Setting it on such a stack
+	// replaces its droplets and DNS records.
+	NamePrefix string
+	// AptUpgrade upgrades each host's packages before anything is installed.
+	AptUpgrade bool
+	// EgressRules restricts the cloud firewall's outbound traffic to what
+	// they allow. Empty leaves it open.
+	EgressRules []egressRuleSpec
+}
+
+// monitoringAgentSpec optionally overrides the default cAdvisor sidecar.
+type monitoringAgentSpec struct {
+	Enabled bool     `json:"enabled"`
+	Image   string   `json:"image"`
+	RunArgs []string `json:"runArgs"`
+}
+
+// environmentSpec sizes the deployment for a single stack.
+type environmentSpec struct {
+	Count int    `json:"count"`
+	Size  string `json:"size"`
+}
+
+func loadConfig(ctx *pulumi.Context) (*appConfig, error) {
+	var conf = &stackConfig{Config: config.New(ctx, "")}
+	var cfg = &appConfig{
+		SSHKeyName:           stringOrDefault(conf, "sshKeyName", defaultSSHKeyName),
+		PrivateKeyPath:       stringOrDefault(conf, "privateKeyPath", defaultPrivateKeyPath),
+		PublicKey:            conf.Get("sshPublicKey"),
+		PublicKeyPath:        conf.Get("sshPublicKeyPath"),
+		SSHUser:              stringOrDefault(conf, "sshUser", "root"),
+		SSHPort:              intOrDefault(conf, "sshPort", 22),
+		PrivateKey:           conf.GetSecret("privateKey"),
+		HasInlineKey:         conf.Get("privateKey") != "",
+		PrivateKeyPassphrase: conf.GetSecret("privateKeyPassphrase"),
+		Domain:               siteDomain,
+		Region:               stringOrDefault(conf, "region", defaultRegion),
+		EnableCertificate:    boolOrDefault(conf, "enableCertificate", true),
+		UseCaddy:             conf.GetBool("useCaddy"),
+		TargetPort:           intOrDefault(conf, "targetPort", 80),
+		Size:                 stringOrDefault(conf, "size", "s-1vcpu-1gb"),
+		DropletImage:         stringOrDefault(conf, "dropletImage", defaultDropletImage),
+		ResizeInPlace:        conf.GetBool("resizeInPlace"),
+		ReuseCertificates:    conf.GetBool("reuseCertificates"),
+		EnvFilePath:          conf.Get("envFilePath"),
+		DropletCount:         intOrDefault(conf, "dropletCount", 1),
+		ReservedIP:           conf.GetBool("reservedIp"),
+		EnableIPv6:           conf.GetBool("enableIPv6"),
+		EnableDNSAliases:     conf.GetBool("enableDnsAliases"),
+		DNSTTL:               intOrDefault(conf, "dnsTtl", 300),
+		Backups:              conf.GetBool("backups"),
+		SnapshotLabel:        conf.Get("snapshotLabel"),
+		TailLogs:             conf.GetBool("tailLogs"),
+		Harden:               conf.GetBool("harden"),
+		AptUpgrade:           conf.GetBool("aptUpgrade"),
+		BanTimeSeconds:       intOrDefault(conf, "fail2banBanTimeSeconds", 3600),
+		MaxRetry:             intOrDefault(conf, "fail2banMaxRetry", 5),
+		BlueGreen:            conf.GetBool("blueGreen"),
+		ProxyProtocol:        conf.GetBool("proxyProtocol"),
+		SwapSizeMb:           conf.GetInt("swapSizeMb"),
+		ActiveSlot:           stringOrDefault(conf, "activeSlot", "blue"),
+		TailLogLines:         intOrDefault(conf, "tailLogLines", 200),
+		TailLogUnit:          conf.Get("tailLogUnit"),
+		BuildImage:           conf.GetBool("buildImage"),
+		RegistryName:         stringOrDefault(conf, "registryName", "rocket"),
+		BuildContext:         stringOrDefault(conf, "buildContext", "."),
+		DeployLock:           conf.GetBool("deployLock"),
+		DeployLockTTL:        time.Duration(intOrDefault(conf, "deployLockTtlMinutes", 60)) * time.Minute,
+		EgressCheckURL:       conf.Get("egressCheckUrl"),
+		ScanImage:            conf.GetBool("scanImage"),
+		Scanner:              stringOrDefault(conf, "scanner", "trivy"),
+		ScanSeverity:         stringOrDefault(conf, "scanSeverity", "high"),
+		DockerVersion:        conf.Get("dockerVersion"),
+		HealthPath:           stringOrDefault(conf, "healthPath", "/"),
+		HealthStatus:         conf.GetInt("healthStatus"),
+		HealthAttempts:       intOrDefault(conf, "healthAttempts", 30),
+		HealthInterval:       intOrDefault(conf, "healthIntervalSeconds", 2),
+		ImageTagFromGit:      conf.GetBool("imageTagFromGit"),
+		ImagePrunePolicy:     stringOrDefault(conf, "imagePrunePolicy", "dangling"),
+		ImagePruneOlderThan:  conf.Get("imagePruneOlderThan"),
+		HTTP2:                conf.GetBool("http2"),
+		HTTP3:                conf.GetBool("http3"),
+		CheckDomainReachable: conf.GetBool("checkDomainReachable"),
+		IntegrationTestPath:  conf.Get("integrationTestPath"),
+		IntegrationTestToken: conf.GetSecret("integrationTestToken"),
+		DeleteProtection:     conf.GetBool("deleteProtection") || conf.GetBool("protect"),
+		DestroyConfirmation:  conf.Get("destroyConfirmation"),
+		RollbackDNS:          conf.GetBool("rollbackDns"),
+		CreateGoldenSnapshot: conf.GetBool("createGoldenSnapshot"),
+		CommandRetryCount:    intOrDefault(conf, "commandRetryCount", 1),
+		CommandRetryDelay:    time.Duration(intOrDefault(conf, "commandRetryDelaySeconds", 5)) * time.Second,
+		CommandTimeout:       time.Duration(intOrDefault(conf, "commandTimeoutSeconds", 0)) * time.Second,
+		BootTimeout:          time.Duration(intOrDefault(conf, "bootTimeoutSeconds", 300)) * time.Second,
+		PlanOnly:             conf.GetBool("planOnly"),
+		PlanFile:             conf.Get("planFile"),
+		Provider:             stringOrDefault(conf, "provider", "digitalocean"),
+		Provisioner:          stringOrDefault(conf, "provisioner", "ssh"),
+		Runtime:              stringOrDefault(conf, "runtime", "systemd"),
+		DeployTimeout:        time.Duration(conf.GetInt("deployTimeoutMinutes")) * time.Minute,
+		Systemd: SystemdParams{
+			Name:          "rocket",
+			ContainerPort: intOrDefault(conf, "containerPort", 8000),
+			InitFilePath:  conf.Get("initFilePath"),
+			Image:         stringOrDefault(conf, "image", "thesnowmancometh/rocket-hello-world"),
+			ImageTag:      conf.Get("imageTag"),
+			DrainTimeout:  intOrDefault(conf, "drainTimeout", 10),
+			User:          conf.Get("containerUser"),
+			ReadOnly:      conf.GetBool("readOnlyRootfs"),
+			WantedBy:      stringOrDefault(conf, "wantedBy", "multi-user.target"),
+		},
+	}
+	cfg.NamePrefix = conf.Get("namePrefix")
+	if cfg.NamePrefix == "" && conf.GetBool("prefixNames") {
+		cfg.NamePrefix = strings.ToLower(invalidTagChars.ReplaceAllString(ctx.Stack(), "-"))
+	}
+	cfg.Certificates = []certificateSpec{{Name: cfg.prefixed("cert"), Domains: []string{cfg.hostname()}}}
+	if err := objectIfSet(conf, "certificates", &cfg.Certificates); err != nil {
+		return nil, err
+	}
+	cfg.HttpsRules = []httpsRuleSpec{{Domain: cfg.hostname(), EntryPort: 443}}
+	if err := objectIfSet(conf, "httpsRules", &cfg.HttpsRules); err != nil {
+		return nil, err
+	}
+	if err := objectIfSet(conf, "forwardingRules", &cfg.ForwardingRules); err != nil {
+		return nil, err
+	}
+	if err := objectIfSet(conf, "egressRules", &cfg.EgressRules); err != nil {
+		return nil, err
+	}
+	if err := objectIfSet(conf, "sshSourceAddresses", &cfg.SSHSourceAddresses); err != nil {
+		return nil, err
+	}
+	if cfg.SSHSourceAddresses == nil {
+		cfg.SSHSourceAddresses = anywhere
+	}
+	cfg.SSHTarget = sshTarget{User: "root"}
+	if err := objectIfSet(conf, "sshTarget", &cfg.SSHTarget); err != nil {
+		return nil, err
+	}
+	cfg.Project = projectSpec{Purpose: "Web Application"}
+	if err := objectIfSet(conf, "project", &cfg.Project); err != nil {
+		return nil, err
+	}
+	if err := objectIfSet(conf, "dnsAliases", &cfg.DNSAliases); err != nil {
+		return nil, err
+	}
+	if cfg.DNSAliases == nil {
+		cfg.DNSAliases = []string{"www"}
+	}
+	cfg.Database = defaultDatabase
+	cfg.Database.Name = cfg.prefixed(defaultDatabase.Name)
+	if err := objectIfSet(conf, "database", &cfg.Database); err != nil {
+		return nil, err
+	}
+	if cfg.TailLogUnit == "" {
+		cfg.TailLogUnit = cfg.Systemd.UnitFile()
+	}
+	cfg.Alerts = defaultAlerts
+	if err := objectIfSet(conf, "alerts", &cfg.Alerts); err != nil {
+		return nil, err
+	}
+	cfg.Alerts.SlackURL = conf.GetSecret("alertsSlackUrl")
+	cfg.Alerts.HasSlackURL = conf.Get("alertsSlackUrl") != ""
+	cfg.StaticAssets = defaultStaticAssets
+	if err := objectIfSet(conf, "staticAssets", &cfg.StaticAssets); err != nil {
+		return nil, err
+	}
+	cfg.LBSizing = defaultLBSizing
+	if err := objectIfSet(conf, "lbSizing", &cfg.LBSizing); err != nil {
+		return nil, err
+	}
+	cfg.LBStickySessions = defaultLBStickySessions
+	if err := objectIfSet(conf, "stickySessions", &cfg.LBStickySessions); err != nil {
+		return nil, err
+	}
+	cfg.LBHealthcheck = defaultLBHealthcheck
+	if err := objectIfSet(conf, "lbHealthcheck", &cfg.LBHealthcheck); err != nil {
+		return nil, err
+	}
+	if err := objectIfSet(conf, "vpc", &cfg.VPC); err != nil {
+		return nil, err
+	}
+	if err := objectIfSet(conf, "composeServices", &cfg.ComposeServices); err != nil {
+		return nil, err
+	}
+	if err := objectIfSet(conf, "customSteps", &cfg.CustomSteps); err != nil {
+		return nil, err
+	}
+	if err := objectIfSet(conf, "registryAuth", &cfg.RegistryAuth); err != nil {
+		return nil, err
+	}
+	cfg.RegistryAuth.Token = conf.GetSecret("registryToken")
+	cfg.RegistryAuth.HasToken = conf.Get("registryToken") != ""
+	var agent monitoringAgentSpec
+	if err := objectIfSet(conf, "monitoringAgent", &agent); err != nil {
+		return nil, err
+	}
+	if agent.Enabled {
+		var sidecar = cadvisorSidecar
+		if agent.Image != "" {
+			sidecar = SidecarParams{Name: "monitoring-agent", Image: agent.Image}
+		}
+		if agent.RunArgs != nil {
+			sidecar.RunArgs = agent.RunArgs
+		}
+		cfg.Systemd.Sidecars = append(cfg.Systemd.Sidecars, sidecar)
+	}
+	if err := objectIfSet(conf, "tags", &cfg.Tags); err != nil {
+		return nil, err
+	}
+	if err := objectIfSet(conf, "environment", &cfg.Systemd.Environment); err != nil {
+		return nil, err
+	}
+	if err := objectIfSet(conf, "secretEnvironment", &cfg.SecretEnvironment); err != nil {
+		return nil, err
+	}
+	if err := objectIfSet(conf, "envFileKeys", &cfg.EnvFileKeys); err != nil {
+		return nil, err
+	}
+	if cfg.EnvFileKeys == nil {
+		cfg.EnvFileKeys = defaultEnvFileKeys
+	}
+	// provisionOnly turns the program into a provisioner for a host that
+	// already exists: no droplet, LB, certificate or DNS is created, only the
+	// copy-unit and systemd steps run over the sshTarget connection.
+	if conf.GetBool("provisionOnly") {
+		cfg.Provider = "ssh"
+	}
+	var user, _ = cfg.sshLogin()
+	cfg.UseSudo = boolOrDefault(conf, "useSudo", user != "root")
+	if err := cfg.resolveEnvironment(conf, ctx.Stack()); err != nil {
+		return nil, err
+	}
+	if err := conf.err(); err != nil {
+		return nil, err
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	if err := checkSecrets(conf, cfg); err != nil {
+		return nil, err
+	}
+	if err := checkLocalFiles(cfg); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// resolveEnvironment applies the count and size for the current stack when
+// the config carries an "environments" map, e.g.
+//
+//	environments:
+//	  dev:  {count: 1, size: s-1vcpu-1gb}
+//	  prod: {count: 3, size: s-2vcpu-4gb}
+func (c *appConfig) resolveEnvironment(conf *stackConfig, stack string) error {
+	var environments map[string]environmentSpec
+	if err := objectIfSet(conf, "environments", &environments); err != nil {
+		return err
+	}
+	if environments == nil {
+		return nil
+	}
+	var env, ok = environments[stack]
+	if !ok {
+		return fmt.Errorf("environments has no entry for stack %q", stack)
+	}
+	if env.Count != 0 {
+		c.DropletCount = env.Count
+	}
+	if env.Size != "" {
+		c.Size = env.Size
+	}
+	return nil
+}
+
+// protected reports whether the droplets, reserved IP and database should be
+// protected from deletion. It is set per stack, with `pulumi config set
+// protect true` (or deleteProtection). `pulumi destroy` doesn't run this
+// program, so tearing down a protected stack takes an explicit unprotect first:
+//
+//	pulumi config set destroyConfirmation <stack name>
+//	pulumi up       # drops the protection
+//	pulumi destroy
+func (c *appConfig) protected(stack string) bool {
+	return c.DeleteProtection && c.DestroyConfirmation != stack
+}
+
+func (c *appConfig) validate() error {
+	for _, key := range c.EnvFileKeys {
+		if !envVarPattern.MatchString(key) {
+			return fmt.Errorf("envFileKeys: %q is not a valid variable name", key)
+		}
+	}
+	for _, tag := range c.Tags {
+		if !tagPattern.MatchString(tag) {
+			return fmt.Errorf("tag %q may only contain letters, numbers, colons, dashes and underscores", tag)
+		}
+	}
+	for _, spec := range c.Certificates {
+		if err := spec.validate(); err != nil {
+			return err
+		}
+	}
+	if strings.ContainsRune(c.EgressCheckURL, '\'') {
+		return fmt.Errorf("egressCheckUrl must not contain single quotes")
+	}
+	if !strings.HasPrefix(c.HealthPath, "/") || strings.ContainsRune(c.HealthPath, '\'') {
+		return fmt.Errorf("healthPath must start with / and contain no quotes, got %q", c.HealthPath)
+	}
+	if c.HealthStatus != 0 && (c.HealthStatus < 100 || c.HealthStatus > 599) {
+		return fmt.Errorf("healthStatus must be an HTTP status code, or 0 for any 2xx, got %d", c.HealthStatus)
+	}
+	if c.HealthAttempts < 1 || c.HealthInterval < 1 {
+		return fmt.Errorf("healthAttempts and healthIntervalSeconds must be at least 1")
+	}
+	switch c.ImagePrunePolicy {
+	case "off", "dangling", "all":
+	default:
+		return fmt.Errorf("imagePrunePolicy must be off, dangling or all, got %q", c.ImagePrunePolicy)
+	}
+	if c.ImagePruneOlderThan != "" && !pruneAgePattern.MatchString(c.ImagePruneOlderThan) {
+		return fmt.Errorf("imagePruneOlderThan must be a duration like 72h, got %q", c.ImagePruneOlderThan)
+	}
+	if !dockerVersionPattern.MatchString(c.DockerVersion) {
+		return fmt.Errorf("dockerVersion %q is not an apt version string", c.DockerVersion)
+	}
+	if err := validateCustomSteps(c.CustomSteps, c.Systemd.Sidecars); err != nil {
+		return err
+	}
+	if err := c.RegistryAuth.validate(); err != nil {
+		return err
+	}
+	if c.BuildImage {
+		if !registryNamePattern.MatchString(c.RegistryName) {
+			return fmt.Errorf("registryName %q must be lowercase letters, digits and dashes", c.RegistryName)
+		}
+		// The droplet pulls from the private registry, so it needs to log
+		// in. A missing registryToken is reported with the other secrets.
+		if c.RegistryAuth.Server == "" || c.RegistryAuth.Username == "" {
+			return fmt.Errorf("buildImage needs registryAuth for registry.digitalocean.com so the droplet can pull the image")
+		}
+	}
+	if err := validateSourceAddresses("sshSourceAddresses", c.SSHSourceAddresses); err != nil {
+		return err
+	}
+	if err := c.LBHealthcheck.validate(); err != nil {
+		return err
+	}
+	if err := c.LBStickySessions.validate(); err != nil {
+		return err
+	}
+	if err := c.LBSizing.validate(); err != nil {
+		return err
+	}
+	if err := c.Project.validate(); err != nil {
+		return err
+	}
+	if err := c.Database.validate(); err != nil {
+		return err
+	}
+	if c.NamePrefix != "" && (!dnsLabelPattern.MatchString(c.NamePrefix) || len(c.NamePrefix) > 20) {
+		return fmt.Errorf("namePrefix %q must be a DNS label of at most 20 characters", c.NamePrefix)
+	}
+	if c.DNSTTL < 30 || c.DNSTTL > 86400 {
+		return fmt.Errorf("dnsTtl must be between 30 and 86400 seconds, got %d", c.DNSTTL)
+	}
+	if c.EnableDNSAliases {
+		if c.Provider != "digitalocean" {
+			return fmt.Errorf("enableDnsAliases needs the digitalocean provider")
+		}
+		for _, alias := range c.DNSAliases {
+			if !dnsLabelPattern.MatchString(alias) || alias == siteSubdomain {
+				return fmt.Errorf("dnsAliases: %q is not a DNS label other than pulumi", alias)
+			}
+		}
+	}
+	if c.TailLogs && (c.TailLogLines < 1 || !systemdUnitNamePattern.MatchString(c.TailLogUnit)) {
+		return fmt.Errorf("tailLogLines must be at least 1 and tailLogUnit a unit name such as rocket.service")
+	}
+	if c.Harden && (c.BanTimeSeconds < 1 || c.MaxRetry < 1) {
+		return fmt.Errorf("fail2banBanTimeSeconds and fail2banMaxRetry must be at least 1")
+	}
+	if c.SwapSizeMb < 0 || c.SwapSizeMb > 16384 {
+		return fmt.Errorf("swapSizeMb must be between 0 and 16384, got %d", c.SwapSizeMb)
+	}
+	if c.ProxyProtocol && (c.Provider != "digitalocean" || c.UseCaddy) {
+		return fmt.Errorf("proxyProtocol needs the digitalocean provider's load balancer, without useCaddy")
+	}
+	if c.BlueGreen {
+		if c.Provider != "digitalocean" || c.UseCaddy {
+			return fmt.Errorf("blueGreen needs the digitalocean provider's load balancer, without useCaddy")
+		}
+		if !containsString(deploySlots, c.ActiveSlot) {
+			return fmt.Errorf("activeSlot must be blue or green, got %q", c.ActiveSlot)
+		}
+	}
+	for key := range c.SecretEnvironment {
+		if !envVarPattern.MatchString(key) {
+			return fmt.Errorf("secretEnvironment: %q is not a valid variable name", key)
+		}
+	}
+	for _, rule := range c.EgressRules {
+		if err := rule.validate(); err != nil {
+			return err
+		}
+	}
+	if len(c.EgressRules) > 0 && c.Provider != "digitalocean" {
+		return fmt.Errorf("egressRules needs the digitalocean provider's cloud firewall")
+	}
+	for _, rule := range c.ForwardingRules {
+		if err := rule.validate(); err != nil {
+			return err
+		}
+	}
+	if len(c.ForwardingRules) > 0 && c.Provider == "digitalocean" && !c.UseCaddy {
+		var covered = func(domain string) bool {
+			return c.EnableCertificate && certificatesCover(c.Certificates, domain)
+		}
+		if err := validateForwardingRules(resolveForwardingRules(c.ForwardingRules, c.hostname()), covered, firewallPorts); err != nil {
+			return err
+		}
+	}
+	if err := c.Alerts.validate(); err != nil {
+		return err
+	}
+	if c.Alerts.Enabled && c.Provider != "digitalocean" {
+		return fmt.Errorf("alerts needs the digitalocean provider")
+	}
+	if err := c.StaticAssets.validate(); err != nil {
+		return err
+	}
+	if c.StaticAssets.Enabled && (c.Provider != "digitalocean" || c.UseCaddy || !c.EnableCertificate) {
+		return fmt.Errorf("staticAssets needs the digitalocean provider's load balancer and its certificates, without useCaddy")
+	}
+	if err := c.VPC.validate(); err != nil {
+		return err
+	}
+	if c.VPC.enabled() && c.Provider != "digitalocean" {
+		return fmt.Errorf("vpc needs the digitalocean provider")
+	}
+	if c.Database.Enabled && c.Provider != "digitalocean" {
+		return fmt.Errorf("database needs the digitalocean provider")
+	}
+	if c.Project.enabled() && c.Provider != "digitalocean" {
+		return fmt.Errorf("project needs the digitalocean provider")
+	}
+	if err := c.Systemd.validate(); err != nil {
+		return err
+	}
+	if c.TargetPort < 1 || c.TargetPort > 65535 {
+		return fmt.Errorf("targetPort must be between 1 and 65535, got %d", c.TargetPort)
+	}
+	if c.Provider != "digitalocean" && c.Provider != "ssh" {
+		return fmt.Errorf("provider must be digitalocean or ssh, got %q", c.Provider)
+	}
+	if c.Provider == "digitalocean" && !containsString(digitalOceanRegions, c.Region) {
+		return fmt.Errorf("region %q is not a DigitalOcean region; expected one of %s", c.Region, strings.Join(digitalOceanRegions, ", "))
+	}
+	if !dropletImagePattern.MatchString(c.DropletImage) {
+		return fmt.Errorf("dropletImage %q is not an image slug or ID", c.DropletImage)
+	}
+	if err := c.validateProvisioner(); err != nil {
+		return err
+	}
+	switch c.Runtime {
+	case "systemd":
+		if len(c.ComposeServices) > 0 {
+			return fmt.Errorf("composeServices needs runtime compose")
+		}
+	case "compose":
+		if err := validateComposeServices(c.Systemd.Name, c.ComposeServices); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("runtime must be systemd or compose, got %q", c.Runtime)
+	}
+	if !sshUserPattern.MatchString(c.SSHUser) {
+		return fmt.Errorf("sshUser %q is not a valid user name", c.SSHUser)
+	}
+	if c.SSHPort < 1 || c.SSHPort > 65535 {
+		return fmt.Errorf("sshPort must be between 1 and 65535, got %d", c.SSHPort)
+	}
+	// Caddy and sidecars install their units straight into /etc, which only
+	// root can do.
+	if c.UseSudo && (c.UseCaddy || len(c.Systemd.Sidecars) > 0) {
+		return fmt.Errorf("useSudo can't be combined with useCaddy or sidecars yet")
+	}
+	if c.PublicKey != "" && c.PublicKeyPath != "" {
+		return fmt.Errorf("set sshPublicKey or sshPublicKeyPath, not both")
+	}
+	if c.Provider == "ssh" && c.SSHTarget.Host == "" {
+		return fmt.Errorf("provisionOnly and the ssh provider need sshTarget.host")
+	}
+	if c.SnapshotLabel != "" && (c.Provider != "digitalocean" || !dnsLabelPattern.MatchString(c.SnapshotLabel)) {
+		return fmt.Errorf("snapshotLabel needs the digitalocean provider and must be lowercase letters, digits and dashes")
+	}
+	if c.CreateGoldenSnapshot && c.Provider != "digitalocean" {
+		return fmt.Errorf("createGoldenSnapshot needs the digitalocean provider")
+	}
+	if c.ReservedIP && c.Provider != "digitalocean" {
+		return fmt.Errorf("reservedIp needs the digitalocean provider")
+	}
+	// The load balancer has no IPv6 address, so an AAAA record would skip it
+	// and reach a droplet that doesn't terminate TLS.
+	if c.EnableIPv6 && (c.Provider != "digitalocean" || !c.UseCaddy) {
+		return fmt.Errorf("enableIPv6 needs the digitalocean provider with useCaddy")
+	}
+	if c.CommandRetryCount < 1 || c.CommandRetryDelay < 0 {
+		return fmt.Errorf("commandRetryCount must be at least 1 and commandRetryDelaySeconds not negative")
+	}
+	if c.CommandTimeout < 0 {
+		return fmt.Errorf("commandTimeoutSeconds must not be negative")
+	}
+	if c.BootTimeout < time.Second {
+		return fmt.Errorf("bootTimeoutSeconds must be at least 1")
+	}
+	if c.DeployLock && (c.Provider != "digitalocean" || c.DeployLockTTL < time.Minute) {
+		return fmt.Errorf("deployLock needs the digitalocean provider's DNS domain, and deployLockTtlMinutes of at least 1")
+	}
+	if c.DeployTimeout < 0 {
+		return fmt.Errorf("deployTimeoutMinutes must not be negative")
+	}
+	if c.DropletCount < 1 {
+		return fmt.Errorf("droplet count must be at least 1, got %d", c.DropletCount)
+	}
+	// Without the LB there is nothing to spread traffic across droplets, and
+	// an existing host is only ever one machine.
+	if c.DropletCount > 1 && (c.Provider != "digitalocean" || c.UseCaddy) {
+		return fmt.Errorf("droplet count %d needs the digitalocean provider and the load balancer (useCaddy off)", c.DropletCount)
+	}
+	return nil
+}
+
+// validateProvisioner rejects settings that only the SSH provisioner can
+// honour when the droplet provisions itself with cloud-init.
+func (c *appConfig) validateProvisioner() error {
+	switch c.Provisioner {
+	case "ssh":
+		return nil
+	case "cloud-init":
+	default:
+		return fmt.Errorf("provisioner must be ssh or cloud-init, got %q", c.Provisioner)
+	}
+	var sshOnly []string
+	if c.Provider != "digitalocean" {
+		sshOnly = append(sshOnly, "the ssh provider")
+	}
+	if c.UseCaddy {
+		sshOnly = append(sshOnly, "useCaddy")
+	}
+	if len(c.Systemd.Sidecars) > 0 {
+		sshOnly = append(sshOnly, "sidecars and monitoringAgent")
+	}
+	if len(c.CustomSteps) > 0 {
+		sshOnly = append(sshOnly, "customSteps")
+	}
+	if c.RegistryAuth.enabled() {
+		sshOnly = append(sshOnly, "registryAuth")
+	}
+	if c.DockerVersion != "" {
+		sshOnly = append(sshOnly, "dockerVersion")
+	}
+	if c.CreateGoldenSnapshot {
+		sshOnly = append(sshOnly, "createGoldenSnapshot")
+	}
+	if c.Runtime == "compose" {
+		sshOnly = append(sshOnly, "runtime compose")
+	}
+	if c.SwapSizeMb > 0 {
+		sshOnly = append(sshOnly, "swapSizeMb")
+	}
+	if c.Harden {
+		sshOnly = append(sshOnly, "harden")
+	}
+	if c.AptUpgrade {
+		sshOnly = append(sshOnly, "aptUpgrade")
+	}
+	if len(sshOnly) > 0 {
+		return fmt.Errorf("provisioner cloud-init can't be combined with %s", strings.Join(sshOnly, ", "))
+	}
+	return nil
+}
+
+// stackConfig is the stack's config. It remembers every value that doesn't
+// parse as the type it is read as, so that loadConfig fails on a typo such as
+// `dropletCount: two` instead of quietly using the default.
+type stackConfig struct {
+	*config.Config
+	invalid []string
+}
+
+// GetBool shadows config.Config's, which reads an unparseable value as false.
+func (c *stackConfig) GetBool(key string) bool {
+	return boolOrDefault(c, key, false)
+}
+
+// GetInt shadows config.Config's, which reads an unparseable value as 0.
+func (c *stackConfig) GetInt(key string) int {
+	return intOrDefault(c, key, 0)
+}
+
+// err reports every value that failed to parse.
+func (c *stackConfig) err() error {
+	if len(c.invalid) == 0 {
+		return nil
+	}
+	return fmt.Errorf("invalid config: %s", strings.Join(c.invalid, "; "))
+}
+
+func boolOrDefault(conf *stackConfig, key string, fallback bool) bool {
+	if conf.Get(key) == "" {
+		return fallback
+	}
+	var val, err = conf.TryBool(key)
+	if err != nil {
+		conf.invalid = append(conf.invalid, fmt.Sprintf("%q must be true or false, got %q", key, conf.Get(key)))
+		return fallback
+	}
+	return val
+}
+
+func stringOrDefault(conf *stackConfig, key, fallback string) string {
+	var val = conf.Get(key)
+	if val == "" {
+		return fallback
+	}
+	return val
+}
+
+func intOrDefault(conf *stackConfig, key string, fallback int) int {
+	if conf.Get(key) == "" {
+		return fallback
+	}
+	var val, err = conf.TryInt(key)
+	if err != nil {
+		conf.invalid = append(conf.invalid, fmt.Sprintf("%q must be an integer, got %q", key, conf.Get(key)))
+		return fallback
+	}
+	return val
+}
+
+// objectIfSet leaves output untouched when key is unset, so callers can
+// populate defaults beforehand.
+func objectIfSet(conf *stackConfig, key string, output interface{}) error {
+	if conf.Get(key) == "" {
+		return nil
+	}
+	if err := conf.GetObject(key, output); err != nil {
+		return fmt.Errorf("invalid config %q: %w", key, err)
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLoadConfigRejectsUnparseableValues(t *testing.T) {
+	var m = &mocks{}
+	var err = runDeploy(t, m, map[string]string{
+		"dropletCount": "two",
+		"backups":      "yes please",
+	})
+	if err == nil {
+		t.Fatal("want an error for the unparseable values, got none")
+	}
+	for _, want := range []string{`"dropletCount" must be an integer, got "two"`, `"backups" must be true or false`} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q doesn't mention %s", err, want)
+		}
+	}
+	if len(m.resources) != 0 {
+		t.Errorf("registered %d resources before failing", len(m.resources))
+	}
+}
+
+func TestLoadConfigRejectsForwardingRulesBeforeRegistering(t *testing.T) {
+	var m = &mocks{}
+	var err = runDeploy(t, m, map[string]string{
+		"forwardingRules": `[
+			{"entryPort": 443, "entryProtocol": "https", "targetPort": 80, "targetProtocol": "http", "domain": "other.example.org"},
+			{"entryPort": 443, "entryProtocol": "http", "targetPort": 8080, "targetProtocol": "http"}
+		]`,
+	})
+	if err == nil {
+		t.Fatal("want an error for the forwarding rules, got none")
+	}
+	for _, want := range []string{"no certificate for other.example.org", "entry port 443 is used by more than one rule", "targets port 8080"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q doesn't mention %s", err, want)
+		}
+	}
+	if len(m.resources) != 0 {
+		t.Errorf("registered %d resources before failing", len(m.resources))
+	}
+}
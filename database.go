@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/pulumi/pulumi-digitalocean/sdk/v4/go/digitalocean"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+// databaseSpec describes the managed Postgres cluster the service uses.
+type databaseSpec struct {
+	Enabled   bool   `json:"enabled"`
+	Version   string `json:"version"`
+	Size      string `json:"size"`
+	NodeCount int    `json:"nodeCount"`
+	// Name names the cluster, and Database and User what is created in it.
+	Name     string `json:"name"`
+	Database string `json:"database"`
+	User     string `json:"user"`
+	// EnvVar is the unit environment variable the connection URI is set in.
+	EnvVar string `json:"envVar"`
+}
+
+var defaultDatabase = databaseSpec{
+	Version:   "14",
+	Size:      "db-s-1vcpu-1gb",
+	NodeCount: 1,
+	Name:      "rocket-db",
+	Database:  "rocket",
+	User:      "rocket",
+	EnvVar:    "DATABASE_URL",
+}
+
+func (d databaseSpec) validate() error {
+	if !d.Enabled {
+		return nil
+	}
+	if d.NodeCount < 1 || d.NodeCount > 3 {
+		return fmt.Errorf("database.nodeCount must be between 1 and 3, got %d", d.NodeCount)
+	}
+	if d.Name == "" || d.Database == "" || d.User == "" || d.Size == "" {
+		return fmt.Errorf("database needs a name, database, user and size")
+	}
+	if !envVarPattern.MatchString(d.EnvVar) {
+		return fmt.Errorf("database.envVar %q is not a valid variable name", d.EnvVar)
+	}
+	return nil
+}
+
+// appDatabase is the cluster and the URI the service connects with.
+type appDatabase struct {
+	Cluster *digitalocean.DatabaseCluster
+	// URI reaches the cluster over the region's private network, as the
+	// service's own user and database. It is a secret.
+	URI pulumi.StringOutput
+}
+
+// createDatabase creates the cluster in the vpcId VPC, or the region's
+// default one when vpcId is nil.
+func createDatabase(ctx *pulumi.Context, spec databaseSpec, region string, vpcId pulumi.StringPtrInput, opts ...pulumi.ResourceOption) (*appDatabase, error) {
+	fmt.Println("Creating Database.")
+	var cluster, err = digitalocean.NewDatabaseCluster(ctx, "rocket-db", &digitalocean.DatabaseClusterArgs{
+		Name:               pulumi.String(spec.Name),
+		Engine:             pulumi.String("pg"),
+		Version:            pulumi.String(spec.Version),
+		Size:               pulumi.String(spec.Size),
+		NodeCount:          pulumi.Int(spec.NodeCount),
+		Region:             pulumi.String(region),
+		PrivateNetworkUuid: vpcId,
+	}, opts...)
+	if err != nil {
+		return nil, err
+	}
+	db, err := digitalocean.NewDatabaseDb(ctx, "rocket-db-database", &digitalocean.DatabaseDbArgs{
+		ClusterId: cluster.ID(),
+		Name:      pulumi.String(spec.Database),
+	}, opts...)
+	if err != nil {
+		return nil, err
+	}
+	user, err := digitalocean.NewDatabaseUser(ctx, "rocket-db-user", &digitalocean.DatabaseUserArgs{
+		ClusterId: cluster.ID(),
+		Name:      pulumi.String(spec.User),
+	}, opts...)
+	if err != nil {
+		return nil, err
+	}
+	var uri = pulumi.Sprintf("postgresql://%s:%s@%s:%d/%s?sslmode=require", user.Name, user.Password, cluster.PrivateHost, cluster.Port, db.Name)
+	return &appDatabase{Cluster: cluster, URI: pulumi.ToSecret(uri).(pulumi.StringOutput)}, nil
+}
+
+// trustDroplets only lets the given droplets connect to the cluster.
+func trustDroplets(ctx *pulumi.Context, cluster *digitalocean.DatabaseCluster, dropletIds []pulumi.StringOutput, opts ...pulumi.ResourceOption) (*digitalocean.DatabaseFirewall, error) {
+	var rules = digitalocean.DatabaseFirewallRuleArray{}
+	for _, id := range dropletIds {
+		rules = append(rules, digitalocean.DatabaseFirewallRuleArgs{
+			Type:  pulumi.String("droplet"),
+			Value: id,
+		})
+	}
+	return digitalocean.NewDatabaseFirewall(ctx, "rocket-db-firewall", &digitalocean.DatabaseFirewallArgs{
+		ClusterId: cluster.ID(),
+		Rules:     rules,
+	}, opts...)
+}
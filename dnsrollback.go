@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/pulumi/pulumi-command/sdk/go/command/local"
+	"github.com/pulumi/pulumi-digitalocean/sdk/v4/go/digitalocean"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+// dnsRollbackScript checks the site through the new DNS target and, if it
+// doesn't answer, points the record back at PRIOR_IP before failing. The
+// check pins the hostname to NEW_IP, so resolver caching can't mask a broken
+// cutover. On success it sets the record to NEW_IP itself, since an earlier
+// rollback may have left it on PRIOR_IP while Pulumi's state says NEW_IP.
+const dnsRollbackScript = `if curl -fsS -o /dev/null --max-time 10 --retry 5 --retry-all-errors \
+	--resolve "$HOSTNAME:80:$NEW_IP" --resolve "$HOSTNAME:443:$NEW_IP" "$CHECK_URL"; then
+	doctl compute domain records update "$DOMAIN" --record-id "$RECORD_ID" --record-data "$NEW_IP" >/dev/null
+	echo "cutover to $NEW_IP is serving"
+	exit 0
+fi
+echo "cutover to $NEW_IP failed; restoring $HOSTNAME to $PRIOR_IP" >&2
+doctl compute domain records update "$DOMAIN" --record-id "$RECORD_ID" --record-data "$PRIOR_IP" >&2
+exit 1`
+
+// priorDnsValue returns what the record points at before this deploy, or ""
+// when there is no record yet and so nothing to roll back to. Any other
+// lookup failure is returned, rather than quietly turning rollback off.
+func priorDnsValue(ctx *pulumi.Context, domain, name string) (string, error) {
+	var record, err = digitalocean.GetRecord(ctx, &digitalocean.GetRecordArgs{
+		Domain: domain,
+		Name:   name,
+	})
+	if err != nil {
+		if isNotFound(err) {
+			ctx.Log.Info(fmt.Sprintf("no existing %s.%s record to roll back to", name, domain), nil)
+			return "", nil
+		}
+		return "", fmt.Errorf("looking up the %s.%s record to roll back to: %w", name, domain, err)
+	}
+	return record.Data, nil
+}
+
+// guardDnsCutover reverts record to prior when the site stops answering
+// after the cutover. The revert happens outside Pulumi, so the state still
+// holds the new value and a plain update wouldn't see a diff. The check
+// failed, though, so it isn't in the state either: the next deploy runs it
+// again, and if the new target answers then, it points the record back at it.
+// The check runs locally and needs doctl on the PATH, authenticated against
+// the same account (e.g. through DIGITALOCEAN_ACCESS_TOKEN).
+func guardDnsCutover(ctx *pulumi.Context, record *digitalocean.DnsRecord, hostname, domain, prior, checkURL string, steps *provisioningSteps, opts ...pulumi.ResourceOption) (*local.Command, error) {
+	var cmdResult, err = local.NewCommand(ctx, "dns-cutover-check", &local.CommandArgs{
+		Create: pulumi.String(dnsRollbackScript),
+		Environment: pulumi.StringMap{
+			"HOSTNAME":  pulumi.String(hostname),
+			"DOMAIN":    pulumi.String(domain),
+			"RECORD_ID": record.ID().ToStringOutput(),
+			"NEW_IP":    record.Value,
+			"PRIOR_IP":  pulumi.String(prior),
+			"CHECK_URL": pulumi.String(checkURL),
+		},
+		Triggers: pulumi.Array{record.Value},
+	}, append(opts, pulumi.DependsOn([]pulumi.Resource{record}))...)
+	if err != nil {
+		return nil, err
+	}
+	outputLocalCmd(steps, "dns-cutover-check", cmdResult, record)
+	return cmdResult, nil
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestRollbackDnsLookupErrors(t *testing.T) {
+	const getRecord = "digitalocean:index/getRecord:getRecord"
+	t.Run("a missing record leaves nothing to roll back to", func(t *testing.T) {
+		var m = &mocks{failing: map[string]error{getRecord: errors.New("record not found")}}
+		if err := runDeploy(t, m, map[string]string{"rollbackDns": "true"}); err != nil {
+			t.Fatal(err)
+		}
+	})
+	t.Run("any other failure fails the deploy", func(t *testing.T) {
+		var m = &mocks{failing: map[string]error{getRecord: errors.New("429 Too Many Requests")}}
+		var err = runDeploy(t, m, map[string]string{"rollbackDns": "true"})
+		if err == nil || !strings.Contains(err.Error(), "429 Too Many Requests") {
+			t.Fatalf("want the lookup's error, got %v", err)
+		}
+	})
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/pulumi/pulumi-command/sdk/go/command/local"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+var defaultEnvFileKeys = map[string]string{
+	"url":  "APP_URL",
+	"ip":   "APP_IP",
+	"lbIp": "APP_LB_IP",
+}
+
+// writeEnvFile mirrors selected outputs into a file that shell tooling can
+// source. keys maps an output name to the variable written for it; outputs
+// without a configured key, or keys without an output, are skipped.
+func writeEnvFile(ctx *pulumi.Context, path string, keys map[string]string, outputs map[string]pulumi.StringInput) (*local.Command, error) {
+	fmt.Println("Writing outputs to", path)
+	var names []string
+	for name := range outputs {
+		if _, ok := keys[name]; ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var env = pulumi.StringMap{"ENV_FILE": pulumi.String(path)}
+	var triggers = pulumi.Array{pulumi.String(path)}
+	var script = []string{`: > "$ENV_FILE"`}
+	for i, name := range names {
+		var envVar = fmt.Sprintf("OUTPUT_%d", i)
+		env[envVar] = outputs[name]
+		triggers = append(triggers, pulumi.String(keys[name]), outputs[name])
+		script = append(script, fmt.Sprintf(`printf '%%s=%%s\n' '%s' "$%s" >> "$ENV_FILE"`, keys[name], envVar))
+	}
+	return local.NewCommand(ctx, "write-env-file", &local.CommandArgs{
+		Create:      pulumi.String(strings.Join(script, "\n")),
+		Delete:      pulumi.String(`rm -f "$ENV_FILE"`),
+		Environment: env,
+		Triggers:    triggers,
+	})
+}
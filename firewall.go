@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+
+	"github.com/pulumi/pulumi-digitalocean/sdk/v4/go/digitalocean"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+var anywhere = []string{"0.0.0.0/0", "::/0"}
+
+// webPorts are open to everyone: the LB's target ports plus 443 for Caddy.
+func webPorts() []int {
+	return append(append([]int{}, firewallPorts...), 443)
+}
+
+func validateSourceAddresses(key string, cidrs []string) error {
+	if len(cidrs) == 0 {
+		return fmt.Errorf("%s must list at least one CIDR, or SSH access is lost", key)
+	}
+	for _, cidr := range cidrs {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return fmt.Errorf("%s: %q is not a CIDR", key, cidr)
+		}
+	}
+	return nil
+}
+
+// inboundRules opens SSH to sshSources and the web ports to everyone, plus
+// UDP 443 for QUIC when http3 is served.
+func inboundRules(sshPort int, sshSources []string, http3 bool) digitalocean.FirewallInboundRuleArray {
+	var rules = digitalocean.FirewallInboundRuleArray{
+		digitalocean.FirewallInboundRuleArgs{
+			Protocol:        pulumi.String("tcp"),
+			PortRange:       pulumi.String(strconv.Itoa(sshPort)),
+			SourceAddresses: pulumi.ToStringArray(sshSources),
+		},
+	}
+	for _, port := range webPorts() {
+		rules = append(rules, digitalocean.FirewallInboundRuleArgs{
+			Protocol:        pulumi.String("tcp"),
+			PortRange:       pulumi.String(strconv.Itoa(port)),
+			SourceAddresses: pulumi.ToStringArray(anywhere),
+		})
+	}
+	if http3 {
+		rules = append(rules, digitalocean.FirewallInboundRuleArgs{
+			Protocol:        pulumi.String("udp"),
+			PortRange:       pulumi.String("443"),
+			SourceAddresses: pulumi.ToStringArray(anywhere),
+		})
+	}
+	return rules
+}
+
+// egressRuleSpec allows outbound traffic of one protocol, to Ports of
+// Destinations. Ports is a port or a range such as 8000-9000, and is left
+// empty for icmp; Destinations defaults to anywhere.
+type egressRuleSpec struct {
+	Protocol     string   `json:"protocol"`
+	Ports        string   `json:"ports"`
+	Destinations []string `json:"destinations"`
+}
+
+var portRangePattern = regexp.MustCompile(`^[0-9]{1,5}(-[0-9]{1,5})?$`)
+
+func (r egressRuleSpec) validate() error {
+	switch r.Protocol {
+	case "tcp", "udp":
+		if !portRangePattern.MatchString(r.Ports) {
+			return fmt.Errorf("egressRules: %s ports %q must be a port or a range such as 8000-9000", r.Protocol, r.Ports)
+		}
+	case "icmp":
+		if r.Ports != "" {
+			return fmt.Errorf("egressRules: icmp rules take no ports")
+		}
+	default:
+		return fmt.Errorf("egressRules: protocol must be tcp, udp or icmp, got %q", r.Protocol)
+	}
+	for _, cidr := range r.Destinations {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return fmt.Errorf("egressRules: %q is not a CIDR", cidr)
+		}
+	}
+	return nil
+}
+
+// outboundRules allows only what egress lists, when it lists anything.
+// Otherwise egress is left open; the image pull, apt and Let's Encrypt all
+// need it. A restricted list must still allow DNS (53/udp) and the registry
+// and apt mirrors (443/tcp and 80/tcp) for provisioning to work.
+func outboundRules(egress []egressRuleSpec) digitalocean.FirewallOutboundRuleArray {
+	var rules = digitalocean.FirewallOutboundRuleArray{}
+	for _, rule := range egress {
+		var destinations = rule.Destinations
+		if len(destinations) == 0 {
+			destinations = anywhere
+		}
+		var args = digitalocean.FirewallOutboundRuleArgs{
+			Protocol:             pulumi.String(rule.Protocol),
+			DestinationAddresses: pulumi.ToStringArray(destinations),
+		}
+		if rule.Ports != "" {
+			args.PortRange = pulumi.String(rule.Ports)
+		}
+		rules = append(rules, args)
+	}
+	if len(rules) > 0 {
+		return rules
+	}
+	for _, protocol := range []string{"tcp", "udp"} {
+		rules = append(rules, digitalocean.FirewallOutboundRuleArgs{
+			Protocol:             pulumi.String(protocol),
+			PortRange:            pulumi.String("1-65535"),
+			DestinationAddresses: pulumi.ToStringArray(anywhere),
+		})
+	}
+	return append(rules, digitalocean.FirewallOutboundRuleArgs{
+		Protocol:             pulumi.String("icmp"),
+		DestinationAddresses: pulumi.ToStringArray(anywhere),
+	})
+}
+
+// createFirewall attaches a cloud firewall to the droplets, and to any other
+// droplet that carries one of tags. Provisioning waits on it, so the rules
+// are in place before anything runs on the host.
+func createFirewall(ctx *pulumi.Context, name string, dropletIds pulumi.IntArray, tags pulumi.StringArray, sshPort int, sshSources []string, http3 bool, egress []egressRuleSpec, opts ...pulumi.ResourceOption) (*digitalocean.Firewall, error) {
+	fmt.Println("Creating Firewall.")
+	return digitalocean.NewFirewall(ctx, "rocket-firewall", &digitalocean.FirewallArgs{
+		Name:          pulumi.String(name),
+		DropletIds:    dropletIds,
+		Tags:          tags,
+		InboundRules:  inboundRules(sshPort, sshSources, http3),
+		OutboundRules: outboundRules(egress),
+	}, opts...)
+}
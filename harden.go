@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"text/template"
+
+	"github.com/pulumi/pulumi-command/sdk/go/command/remote"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+const (
+	fail2banJailPath   = "/etc/fail2ban/jail.d/rocket.local"
+	stagedFail2banJail = "/tmp/rocket-fail2ban.local"
+)
+
+var fail2banJailTemplate = template.Must(template.New("fail2ban").Parse(`[sshd]
+enabled = true
+port = {{.Port}}
+bantime = {{.BanTime}}
+maxretry = {{.MaxRetry}}
+`))
+
+// renderFail2banJail bans an address for banTime seconds once it fails to log
+// in over SSH maxRetry times.
+func renderFail2banJail(sshPort, banTime, maxRetry int) (string, error) {
+	var out bytes.Buffer
+	var err = fail2banJailTemplate.Execute(&out, struct{ Port, BanTime, MaxRetry int }{sshPort, banTime, maxRetry})
+	return out.String(), err
+}
+
+// fail2banScript installs fail2ban only if it's missing, so re-running it
+// just puts the staged jail in place and restarts the service.
+func fail2banScript() string {
+	return fmt.Sprintf(`set -e
+if ! command -v fail2ban-client >/dev/null; then
+	apt-get update
+	DEBIAN_FRONTEND=noninteractive apt-get install -y fail2ban
+fi
+install -D -m 0644 %s %s
+systemctl enable fail2ban
+systemctl restart fail2ban`, stagedFail2banJail, fail2banJailPath)
+}
+
+// fail2banCleanupScript removes the jail, leaving fail2ban itself installed.
+const fail2banCleanupScript = `rm -f ` + fail2banJailPath + `
+systemctl restart fail2ban 2>/dev/null || true`
+
+// hardenSSH copies the rendered jail to the host, then installs and enables
+// fail2ban with it. Changing the jail re-runs the install step.
+func hardenSSH(ctx *pulumi.Context, conn remote.ConnectionInput, options commandOptions, cfg *appConfig, prior pulumi.Resource) (*remote.Command, error) {
+	fmt.Println("Hardening SSH with fail2ban.")
+	var _, port = cfg.sshLogin()
+	if port == 0 {
+		port = 22
+	}
+	var jail, err = renderFail2banJail(port, cfg.BanTimeSeconds, cfg.MaxRetry)
+	if err != nil {
+		return nil, err
+	}
+	copied, err := copyRenderedFile(ctx, "fail2ban-jail.local", jail, stagedFail2banJail, conn, options, prior)
+	if err != nil {
+		return nil, err
+	}
+	var install = options
+	install.Triggers = pulumi.Array{copied.ID()}
+	return chainCommandWithDelete(ctx, "install-fail2ban", options.privileged(fail2banScript()), options.privileged(fail2banCleanupScript), conn, install, copied)
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pulumi/pulumi-command/sdk/go/command/local"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+// resolveImageTag uses the current git commit as the image tag when asked to,
+// falling back to the configured tag outside of a git checkout. The command
+// re-runs on every deploy so a new commit is always picked up.
+func resolveImageTag(ctx *pulumi.Context, fromGit bool, fallback string) (pulumi.StringOutput, error) {
+	if !fromGit {
+		return pulumi.String(fallback).ToStringOutput(), nil
+	}
+	fmt.Println("Resolving image tag from git.")
+	var cmdResult, err = local.NewCommand(ctx, "resolve-image-tag", &local.CommandArgs{
+		Create:      pulumi.String(`git rev-parse HEAD 2>/dev/null || echo "$FALLBACK_TAG"`),
+		Environment: pulumi.StringMap{"FALLBACK_TAG": pulumi.String(fallback)},
+		Triggers:    pulumi.Array{pulumi.String(strconv.FormatInt(time.Now().UnixNano(), 10))},
+	})
+	if err != nil {
+		return pulumi.StringOutput{}, err
+	}
+	return cmdResult.Stdout.ApplyT(strings.TrimSpace).(pulumi.StringOutput), nil
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/pulumi/pulumi-command/sdk/go/command/local"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+// runIntegrationTests runs a local test binary or script against the deployed
+// URL, which it gets as its first argument and as $TARGET_URL alongside the
+// $TEST_TOKEN credential. A non-zero exit fails the deploy. It re-runs whenever anything in
+// triggers changes, i.e. whenever the deploy changed something.
+func runIntegrationTests(ctx *pulumi.Context, testPath, url string, token pulumi.StringOutput, triggers pulumi.Array, deps []pulumi.Resource, steps *provisioningSteps) (*local.Command, error) {
+	fmt.Println("Running integration tests with", testPath)
+	var cmdResult, err = local.NewCommand(ctx, "integration-tests", &local.CommandArgs{
+		Create: pulumi.String(`"$TEST_BINARY" "$TARGET_URL"`),
+		Environment: pulumi.StringMap{
+			"TEST_BINARY": pulumi.String(testPath),
+			"TARGET_URL":  pulumi.String(url),
+			"TEST_TOKEN":  token,
+		},
+		Triggers: append(pulumi.Array{pulumi.String(testPath), pulumi.String(url)}, triggers...),
+	}, pulumi.DependsOn(deps))
+	if err != nil {
+		return nil, err
+	}
+	// The tests see the secret token and may print it, so their output is
+	// kept as a secret.
+	var stdout = pulumi.ToSecret(cmdResult.Stdout).(pulumi.StringOutput)
+	var stderr = pulumi.ToSecret(cmdResult.Stderr).(pulumi.StringOutput)
+	steps.record("integration-tests", stdout, stderr)
+	return cmdResult, nil
+}
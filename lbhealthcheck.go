@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pulumi/pulumi-digitalocean/sdk/v4/go/digitalocean"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+// lbHealthcheckSpec is how the load balancer decides a droplet can take
+// traffic. A droplet that fails it is taken out of rotation until it passes
+// again, e.g. while its service restarts.
+type lbHealthcheckSpec struct {
+	Protocol string `json:"protocol"`
+	Port     int    `json:"port"`
+	// Path is only used by http checks.
+	Path                   string `json:"path"`
+	CheckIntervalSeconds   int    `json:"checkIntervalSeconds"`
+	HealthyThreshold       int    `json:"healthyThreshold"`
+	UnhealthyThreshold     int    `json:"unhealthyThreshold"`
+	ResponseTimeoutSeconds int    `json:"responseTimeoutSeconds"`
+}
+
+// defaultLBHealthcheck checks the service over HTTP on the port the LB
+// forwards to, using DigitalOcean's own default timings.
+var defaultLBHealthcheck = lbHealthcheckSpec{
+	Protocol:               "http",
+	Port:                   80,
+	Path:                   "/",
+	CheckIntervalSeconds:   10,
+	HealthyThreshold:       5,
+	UnhealthyThreshold:     3,
+	ResponseTimeoutSeconds: 5,
+}
+
+// validate reports every problem at once, using DigitalOcean's limits.
+func (h lbHealthcheckSpec) validate() error {
+	var problems []string
+	if h.Protocol != "http" && h.Protocol != "tcp" {
+		problems = append(problems, fmt.Sprintf("protocol must be http or tcp, got %q", h.Protocol))
+	}
+	if h.Port < 1 || h.Port > 65535 {
+		problems = append(problems, fmt.Sprintf("port must be between 1 and 65535, got %d", h.Port))
+	}
+	if h.Protocol == "http" && !strings.HasPrefix(h.Path, "/") {
+		problems = append(problems, fmt.Sprintf("path must start with /, got %q", h.Path))
+	}
+	var bounds = []struct {
+		name     string
+		value    int
+		min, max int
+	}{
+		{"checkIntervalSeconds", h.CheckIntervalSeconds, 3, 300},
+		{"responseTimeoutSeconds", h.ResponseTimeoutSeconds, 3, 300},
+		{"healthyThreshold", h.HealthyThreshold, 2, 10},
+		{"unhealthyThreshold", h.UnhealthyThreshold, 2, 10},
+	}
+	for _, b := range bounds {
+		if b.value < b.min || b.value > b.max {
+			problems = append(problems, fmt.Sprintf("%s must be between %d and %d, got %d", b.name, b.min, b.max, b.value))
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("lbHealthcheck: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+func (h lbHealthcheckSpec) args() *digitalocean.LoadBalancerHealthcheckArgs {
+	var args = &digitalocean.LoadBalancerHealthcheckArgs{
+		Protocol:               pulumi.String(h.Protocol),
+		Port:                   pulumi.Int(h.Port),
+		CheckIntervalSeconds:   pulumi.IntPtr(h.CheckIntervalSeconds),
+		HealthyThreshold:       pulumi.IntPtr(h.HealthyThreshold),
+		UnhealthyThreshold:     pulumi.IntPtr(h.UnhealthyThreshold),
+		ResponseTimeoutSeconds: pulumi.IntPtr(h.ResponseTimeoutSeconds),
+	}
+	if h.Protocol == "http" {
+		args.Path = pulumi.StringPtr(h.Path)
+	}
+	return args
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/pulumi/pulumi-digitalocean/sdk/v4/go/digitalocean"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+// lbSizingSpec sizes the load balancer, either by named Size or by SizeUnit
+// nodes, and picks how it spreads requests across the droplets. Leaving both
+// sizes unset keeps DigitalOcean's default.
+type lbSizingSpec struct {
+	// Size is lb-small, lb-medium or lb-large.
+	Size     string `json:"size"`
+	SizeUnit int    `json:"sizeUnit"`
+	// Algorithm is round_robin or least_connections.
+	Algorithm string `json:"algorithm"`
+}
+
+var defaultLBSizing = lbSizingSpec{
+	Algorithm: "round_robin",
+}
+
+func (s lbSizingSpec) validate() error {
+	if s.Size != "" && s.SizeUnit != 0 {
+		return fmt.Errorf("lbSizing: set size or sizeUnit, not both")
+	}
+	if s.Size != "" && !containsString([]string{"lb-small", "lb-medium", "lb-large"}, s.Size) {
+		return fmt.Errorf("lbSizing.size must be lb-small, lb-medium or lb-large, got %q", s.Size)
+	}
+	if s.SizeUnit < 0 || s.SizeUnit > 100 {
+		return fmt.Errorf("lbSizing.sizeUnit must be between 1 and 100, got %d", s.SizeUnit)
+	}
+	if !containsString([]string{"round_robin", "least_connections"}, s.Algorithm) {
+		return fmt.Errorf("lbSizing.algorithm must be round_robin or least_connections, got %q", s.Algorithm)
+	}
+	return nil
+}
+
+// apply sets the sizing on args, leaving unset sizes to the provider.
+func (s lbSizingSpec) apply(args *digitalocean.LoadBalancerArgs) {
+	args.Algorithm = pulumi.StringPtr(s.Algorithm)
+	if s.Size != "" {
+		args.Size = pulumi.StringPtr(s.Size)
+	}
+	if s.SizeUnit != 0 {
+		args.SizeUnit = pulumi.IntPtr(s.SizeUnit)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/pulumi/pulumi-digitalocean/sdk/v4/go/digitalocean"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+// lbStickySessionsSpec pins each client to one droplet with a cookie the load
+// balancer sets, for apps that keep session state in memory.
+type lbStickySessionsSpec struct {
+	// Type is "none" or "cookies".
+	Type             string `json:"type"`
+	CookieName       string `json:"cookieName"`
+	CookieTtlSeconds int    `json:"cookieTtlSeconds"`
+}
+
+var defaultLBStickySessions = lbStickySessionsSpec{
+	Type:             "none",
+	CookieName:       "DO-LB",
+	CookieTtlSeconds: 300,
+}
+
+var cookieNamePattern = regexp.MustCompile(`^[A-Za-z0-9!#$%&'*+.^_|~-]+$`)
+
+func (s lbStickySessionsSpec) validate() error {
+	switch s.Type {
+	case "none":
+		return nil
+	case "cookies":
+	default:
+		return fmt.Errorf("stickySessions.type must be none or cookies, got %q", s.Type)
+	}
+	if !cookieNamePattern.MatchString(s.CookieName) {
+		return fmt.Errorf("stickySessions.cookieName %q is not a valid cookie name", s.CookieName)
+	}
+	if s.CookieTtlSeconds < 1 {
+		return fmt.Errorf("stickySessions.cookieTtlSeconds must be at least 1, got %d", s.CookieTtlSeconds)
+	}
+	return nil
+}
+
+// args is nil without stickiness, which leaves the LB as it was before
+// sticky sessions were configurable.
+func (s lbStickySessionsSpec) args() digitalocean.LoadBalancerStickySessionsPtrInput {
+	if s.Type != "cookies" {
+		return nil
+	}
+	return &digitalocean.LoadBalancerStickySessionsArgs{
+		Type:             pulumi.StringPtr(s.Type),
+		CookieName:       pulumi.StringPtr(s.CookieName),
+		CookieTtlSeconds: pulumi.IntPtr(s.CookieTtlSeconds),
+	}
+}
+
+// summary describes the stickiness applied, for the stack outputs.
+func (s lbStickySessionsSpec) summary() pulumi.Map {
+	if s.Type != "cookies" {
+		return pulumi.Map{"type": pulumi.String("none")}
+	}
+	return pulumi.Map{
+		"type":             pulumi.String(s.Type),
+		"cookieName":       pulumi.String(s.CookieName),
+		"cookieTtlSeconds": pulumi.Int(s.CookieTtlSeconds),
+	}
+}
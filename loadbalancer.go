@@ -0,0 +1,242 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/pulumi/pulumi-digitalocean/sdk/v4/go/digitalocean"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+// forwardingRule is a plain description of an LB forwarding rule, kept so the
+// rules can be validated and summarised before they become provider inputs.
+type forwardingRule struct {
+	EntryPort      int
+	EntryProtocol  string
+	TargetPort     int
+	TargetProtocol string
+	// Domain is the name whose certificate a TLS-terminating rule uses.
+	Domain string
+	Cert   *digitalocean.Certificate
+	// TLSPassthrough hands TLS to the droplet instead of terminating it.
+	TLSPassthrough bool
+}
+
+// forwardingRuleSpec is a forwarding rule as written in config. Domain picks
+// the certificate for a TLS-terminating entry, defaulting to the site's.
+type forwardingRuleSpec struct {
+	EntryPort      int    `json:"entryPort"`
+	EntryProtocol  string `json:"entryProtocol"`
+	TargetPort     int    `json:"targetPort"`
+	TargetProtocol string `json:"targetProtocol"`
+	TLSPassthrough bool   `json:"tlsPassthrough"`
+	Domain         string `json:"domain"`
+}
+
+var forwardingProtocols = []string{"http", "https", "http2", "tcp"}
+
+func (s forwardingRuleSpec) validate() error {
+	for _, port := range []int{s.EntryPort, s.TargetPort} {
+		if port < 1 || port > 65535 {
+			return fmt.Errorf("forwardingRules: port %d is out of range", port)
+		}
+	}
+	if !containsString(forwardingProtocols, s.EntryProtocol) || !containsString(forwardingProtocols, s.TargetProtocol) {
+		return fmt.Errorf("forwardingRules: protocols must be one of %s, got %s -> %s", strings.Join(forwardingProtocols, ", "), s.EntryProtocol, s.TargetProtocol)
+	}
+	switch {
+	case (s.EntryProtocol == "tcp") != (s.TargetProtocol == "tcp"):
+		return fmt.Errorf("forwardingRules: tcp can only forward to tcp, got %s -> %s", s.EntryProtocol, s.TargetProtocol)
+	case s.TLSPassthrough && (s.EntryProtocol != "https" || s.TargetProtocol != "https"):
+		return fmt.Errorf("forwardingRules: tlsPassthrough needs https on both sides, got %s -> %s", s.EntryProtocol, s.TargetProtocol)
+	case s.EntryProtocol == "http" && s.TargetProtocol != "http":
+		return fmt.Errorf("forwardingRules: plain http can't be forwarded as %s", s.TargetProtocol)
+	}
+	return nil
+}
+
+// resolveForwardingRules picks the domain each TLS-terminating rule needs a
+// certificate for. validateForwardingRules checks that one is configured and
+// attachCertificates fills it in once the certificates exist.
+func resolveForwardingRules(specs []forwardingRuleSpec, hostname string) []forwardingRule {
+	var rules []forwardingRule
+	for _, spec := range specs {
+		var rule = forwardingRule{
+			EntryPort:      spec.EntryPort,
+			EntryProtocol:  spec.EntryProtocol,
+			TargetPort:     spec.TargetPort,
+			TargetProtocol: spec.TargetProtocol,
+			TLSPassthrough: spec.TLSPassthrough,
+		}
+		if rule.terminatesTLS() {
+			rule.Domain = spec.Domain
+			if rule.Domain == "" {
+				rule.Domain = hostname
+			}
+		}
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+func attachCertificates(rules []forwardingRule, certs map[string]*digitalocean.Certificate) []forwardingRule {
+	var attached []forwardingRule
+	for _, rule := range rules {
+		if rule.terminatesTLS() && rule.Cert == nil {
+			rule.Cert, _ = certificateFor(certs, rule.Domain)
+		}
+		attached = append(attached, rule)
+	}
+	return attached
+}
+
+func (r forwardingRule) terminatesTLS() bool {
+	return (r.EntryProtocol == "https" || r.EntryProtocol == "http2") && !r.TLSPassthrough
+}
+
+// servesTLS reports whether clients reach the LB over TLS.
+func servesTLS(rules []forwardingRule) bool {
+	for _, rule := range rules {
+		if rule.EntryProtocol == "https" || rule.EntryProtocol == "http2" {
+			return true
+		}
+	}
+	return false
+}
+
+func (r forwardingRule) String() string {
+	var s = fmt.Sprintf("%s:%d -> %s:%d", r.EntryProtocol, r.EntryPort, r.TargetProtocol, r.TargetPort)
+	if r.terminatesTLS() {
+		s += " (tls)"
+	}
+	if r.TLSPassthrough {
+		s += " (passthrough)"
+	}
+	return s
+}
+
+// buildForwardingRules only includes https rules that have a certificate,
+// so toggling certs off never leaves the LB pointing at a missing cert.
+// DigitalOcean terminates HTTP/2 when the entry protocol is "http2"; this
+// provider version has no HTTP/3 entry protocol, so only Caddy can serve it.
+func buildForwardingRules(httpsRules []httpsRule, http2 bool) []forwardingRule {
+	var tlsProtocol = "https"
+	if http2 {
+		tlsProtocol = "http2"
+	}
+	var rules = []forwardingRule{{
+		EntryPort:      80,
+		EntryProtocol:  "http",
+		TargetPort:     80,
+		TargetProtocol: "http",
+	}}
+	for _, rule := range httpsRules {
+		rules = append(rules, forwardingRule{
+			EntryPort:      rule.EntryPort,
+			EntryProtocol:  tlsProtocol,
+			TargetPort:     80,
+			TargetProtocol: "http",
+			Domain:         rule.Domain,
+			Cert:           rule.Cert,
+		})
+	}
+	return rules
+}
+
+// validateForwardingRules reports every problem at once: duplicate entry
+// ports, TLS entry protocols whose domain no certificate covers, and target
+// ports the droplet's firewall doesn't open.
+func validateForwardingRules(rules []forwardingRule, covered func(domain string) bool, openPorts []int) error {
+	var problems []string
+	var seen = map[int]bool{}
+	var open = map[int]bool{}
+	for _, port := range openPorts {
+		open[port] = true
+	}
+	for _, rule := range rules {
+		if seen[rule.EntryPort] {
+			problems = append(problems, fmt.Sprintf("entry port %d is used by more than one rule", rule.EntryPort))
+		}
+		seen[rule.EntryPort] = true
+		if rule.terminatesTLS() && !covered(rule.Domain) {
+			problems = append(problems, fmt.Sprintf("%s has no certificate for %s", rule, rule.Domain))
+		}
+		if !open[rule.TargetPort] {
+			problems = append(problems, fmt.Sprintf("%s targets port %d, which the droplet firewall doesn't open", rule, rule.TargetPort))
+		}
+	}
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return fmt.Errorf("invalid forwarding rules: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+func summarizeForwardingRules(rules []forwardingRule) []string {
+	var summary []string
+	for _, rule := range rules {
+		summary = append(summary, rule.String())
+	}
+	return summary
+}
+
+func toForwardingRuleArray(rules []forwardingRule) digitalocean.LoadBalancerForwardingRuleArray {
+	var array = digitalocean.LoadBalancerForwardingRuleArray{}
+	for _, rule := range rules {
+		var args = &digitalocean.LoadBalancerForwardingRuleArgs{
+			EntryPort:      pulumi.Int(rule.EntryPort),
+			EntryProtocol:  pulumi.String(rule.EntryProtocol),
+			TargetPort:     pulumi.Int(rule.TargetPort),
+			TargetProtocol: pulumi.String(rule.TargetProtocol),
+		}
+		if rule.Cert != nil {
+			args.CertificateName = rule.Cert.Name
+		}
+		if rule.TLSPassthrough {
+			args.TlsPassthrough = pulumi.BoolPtr(true)
+		}
+		array = append(array, args)
+	}
+	return array
+}
+
+func createLoadBalancer(ctx *pulumi.Context, name, region string, dropletIds pulumi.IntArray, rules []forwardingRule, healthcheck lbHealthcheckSpec, sticky lbStickySessionsSpec, sizing lbSizingSpec, proxyProtocol bool, deps []pulumi.Resource, opts ...pulumi.ResourceOption) (*digitalocean.LoadBalancer, error) {
+	fmt.Println("Creating Load Balancer.")
+	ctx.Export("forwarding-rules", pulumi.ToStringArray(summarizeForwardingRules(rules)))
+	ctx.Export("sticky-sessions", sticky.summary())
+	ctx.Export("proxy-protocol", pulumi.Bool(proxyProtocol))
+	// Pulumi already infers the dependency from cert.Name, but we spell it out
+	// so the LB is never created ahead of the certificates it references.
+	for _, rule := range rules {
+		if rule.Cert != nil {
+			deps = append(deps, rule.Cert)
+		}
+	}
+	if len(deps) > 0 {
+		opts = append(opts, pulumi.DependsOn(deps))
+	}
+	var args = &digitalocean.LoadBalancerArgs{
+		Region:                       pulumi.String(region),
+		Name:                         pulumi.String(name),
+		RedirectHttpToHttps:          pulumi.BoolPtr(servesTLS(rules)),
+		DisableLetsEncryptDnsRecords: pulumi.BoolPtr(true),
+		ForwardingRules:              toForwardingRuleArray(rules),
+		Healthcheck:                  healthcheck.args(),
+		StickySessions:               sticky.args(),
+		EnableProxyProtocol:          pulumi.BoolPtr(proxyProtocol),
+		DropletIds:                   dropletIds,
+	}
+	sizing.apply(args)
+	var lb, err = digitalocean.NewLoadBalancer(ctx, "rocket-lb", args, opts...)
+	if err != nil {
+		return nil, err
+	}
+	// The provider fills in whatever size was left unset.
+	ctx.Export("lb-sizing", pulumi.Map{
+		"size":      lb.Size,
+		"sizeUnit":  lb.SizeUnit,
+		"algorithm": lb.Algorithm,
+	})
+	return lb, nil
+}
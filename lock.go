@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pulumi/pulumi-command/sdk/go/command/local"
+	"github.com/pulumi/pulumi-digitalocean/sdk/v4/go/digitalocean"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+// lockReleased is the sentinel's value while no deploy holds the lock.
+const lockReleased = "released"
+
+const releaseLockScript = `doctl compute domain records update "$DOMAIN" --record-id "$RECORD_ID" --record-data "` + lockReleased + `" >/dev/null
+echo "released the deploy lock taken by run $RUN_ID"`
+
+type deployLock struct {
+	acquire *digitalocean.DnsRecord
+	domain  string
+	runId   string
+}
+
+// lockRecordName is the TXT record holding the stack's deploy lock, next to
+// the site's own record.
+func (c *appConfig) lockRecordName() string {
+	return "_deploy-lock." + c.prefixed(siteSubdomain)
+}
+
+// acquireDeployLock makes a second concurrent `pulumi up` of this stack fail
+// fast, wherever it runs. The sentinel is a TXT record the stack manages,
+// holding "<run id> <expiry>" while a deploy runs and "released" once it's
+// done. It is read before anything else is registered, and an unreleased one
+// left by a deploy that died stops counting once it expires. Stack outputs
+// can't carry it, since they are only written when an update finishes.
+// Releasing it needs doctl, like rollbackDns.
+func acquireDeployLock(ctx *pulumi.Context, domain, name string, ttl time.Duration) (*deployLock, error) {
+	var now = time.Now()
+	var current, err = digitalocean.GetRecord(ctx, &digitalocean.GetRecordArgs{Domain: domain, Name: name})
+	switch {
+	case err == nil:
+		if err := checkLockSentinel(current.Data, now); err != nil {
+			return nil, fmt.Errorf("%w; if that deploy died, wait for the lock to expire or release it with `doctl compute domain records update %s --record-id %s --record-data %s`", err, domain, current.Id, lockReleased)
+		}
+	case !isNotFound(err):
+		return nil, fmt.Errorf("looking up the deploy lock %s.%s: %w", name, domain, err)
+	}
+	var lock = &deployLock{domain: domain, runId: strconv.FormatInt(now.UnixNano(), 10)}
+	fmt.Println("Taking the deploy lock for run", lock.runId)
+	lock.acquire, err = digitalocean.NewDnsRecord(ctx, "deploy-lock", &digitalocean.DnsRecordArgs{
+		Domain: pulumi.String(domain),
+		Name:   pulumi.String(name),
+		Type:   pulumi.String("TXT"),
+		Value:  pulumi.String(fmt.Sprintf("%s %d", lock.runId, now.Add(ttl).Unix())),
+		Ttl:    pulumi.Int(30),
+	})
+	return lock, err
+}
+
+// checkLockSentinel fails when value is another run's unexpired sentinel.
+// Anything it can't parse is treated as released, so a mangled record can't
+// wedge the stack.
+func checkLockSentinel(value string, now time.Time) error {
+	var fields = strings.Fields(strings.Trim(value, `"`))
+	if len(fields) != 2 {
+		return nil
+	}
+	var expires, err = strconv.ParseInt(fields[1], 10, 64)
+	if err != nil || now.Unix() >= expires {
+		return nil
+	}
+	return fmt.Errorf("another deploy of this stack (run %s) holds the deploy lock until %s", fields[0], time.Unix(expires, 0).UTC().Format(time.RFC3339))
+}
+
+func (l *deployLock) release(ctx *pulumi.Context, after ...pulumi.Resource) error {
+	var _, err = local.NewCommand(ctx, "release-deploy-lock", &local.CommandArgs{
+		Create: pulumi.String(releaseLockScript),
+		Environment: pulumi.StringMap{
+			"DOMAIN":    pulumi.String(l.domain),
+			"RECORD_ID": l.acquire.ID().ToStringOutput(),
+			"RUN_ID":    pulumi.String(l.runId),
+		},
+		Triggers: pulumi.Array{pulumi.String(l.runId)},
+	}, pulumi.DependsOn(append(after, l.acquire)))
+	return err
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDeployLock(t *testing.T) {
+	const lockRecord = "_deploy-lock.pulumi"
+	var live = fmt.Sprintf("1700000000000000000 %d", time.Now().Add(time.Hour).Unix())
+	var expired = fmt.Sprintf("1700000000000000000 %d", time.Now().Add(-time.Minute).Unix())
+	t.Run("another run's live sentinel fails the deploy first", func(t *testing.T) {
+		var m = &mocks{records: map[string]string{lockRecord: live}}
+		var err = runDeploy(t, m, map[string]string{"deployLock": "true"})
+		if err == nil || !strings.Contains(err.Error(), "run 1700000000000000000) holds the deploy lock") {
+			t.Fatalf("want the lock holder in the error, got %v", err)
+		}
+		if len(m.resources) != 0 {
+			t.Errorf("registered %d resources before failing", len(m.resources))
+		}
+	})
+	for name, value := range map[string]string{"released": lockReleased, "expired": expired, "missing": ""} {
+		t.Run("a "+name+" sentinel is taken over", func(t *testing.T) {
+			var m = &mocks{records: map[string]string{lockRecord: value}}
+			if err := runDeploy(t, m, map[string]string{"deployLock": "true"}); err != nil {
+				t.Fatal(err)
+			}
+			var sentinel = m.created("digitalocean:index/dnsRecord:DnsRecord")["deploy-lock"]
+			if sentinel == nil {
+				t.Fatal("no deploy-lock record")
+			}
+			if got := sentinel["value"].StringValue(); checkLockSentinel(got, time.Now()) == nil {
+				t.Errorf("sentinel %q doesn't hold the lock", got)
+			}
+			if _, ok := m.created("command:local:Command")["release-deploy-lock"]; !ok {
+				t.Error("the lock is never released")
+			}
+		})
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/pulumi/pulumi-command/sdk/go/command/local"
+	"github.com/pulumi/pulumi-command/sdk/go/command/remote"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+// logTailCommand prints the last lines of the service's logs on the host.
+func logTailCommand(cfg *appConfig) string {
+	var cmd = fmt.Sprintf("journalctl -u %s -n %d --no-pager", cfg.TailLogUnit, cfg.TailLogLines)
+	if cfg.Runtime == "compose" {
+		cmd = composeCommand(cfg.Systemd, fmt.Sprintf("logs --no-color --tail %d", cfg.TailLogLines))
+	}
+	if cfg.UseSudo {
+		cmd = "sudo -n " + cmd
+	}
+	return cmd
+}
+
+// tailServiceLogs fetches the service's logs over ssh from this machine once
+// started has run, and exports them. It doesn't wait for the health check,
+// so the logs are there to read when that is what fails. The host key isn't
+// checked or remembered, just as the provisioning connection doesn't.
+func tailServiceLogs(ctx *pulumi.Context, cfg *appConfig, address pulumi.StringOutput, options commandOptions, started *remote.Command) (*local.Command, error) {
+	fmt.Println("Tailing the service logs.")
+	var ssh = cfg.sshCommand(address, "-o BatchMode=yes", "-o StrictHostKeyChecking=no", "-o UserKnownHostsFile=/dev/null")
+	var name = options.name("tail-service-logs")
+	var cmdResult, err = local.NewCommand(ctx, name, &local.CommandArgs{
+		Create:   pulumi.Sprintf("%s %s", ssh, shellQuote(logTailCommand(cfg))),
+		Triggers: pulumi.Array{started.ID()},
+	}, options.resourceOpts(pulumi.DependsOn([]pulumi.Resource{started}))...)
+	if err != nil {
+		return nil, err
+	}
+	ctx.Export(options.name("service-logs"), cmdResult.Stdout)
+	return cmdResult, nil
+}
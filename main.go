@@ -1,9 +1,12 @@
 package main
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
-	"io/ioutil"
 	"strconv"
+	"strings"
 
 	"github.com/pulumi/pulumi-command/sdk/go/command/local"
 	"github.com/pulumi/pulumi-command/sdk/go/command/remote"
@@ -12,229 +15,783 @@ import (
 )
 
 const (
-	sshKeyName     = "Redacted"
-	privateKeyPath = "/redacted/redacted/.ssh/redacted"
-	initFilePath   = "/etc/systemd/system/rocket.service"
+	// The SSH key defaults apply when sshKeyName and privateKeyPath aren't
+	// configured.
+	defaultSSHKeyName     = "Redacted"
+	defaultPrivateKeyPath = "/redacted/redacted/.ssh/redacted"
+	defaultRegion         = "nyc3"
+	siteDomain            = "robbiemckinstry.tech"
+	siteSubdomain         = "pulumi"
 )
 
-func lookupDomain(ctx *pulumi.Context) (*digitalocean.LookupDomainResult, error) {
+func lookupDomain(ctx *pulumi.Context, name string) (*digitalocean.LookupDomainResult, error) {
 	var res, err = digitalocean.LookupDomain(ctx, &digitalocean.LookupDomainArgs{
-		Name: "robbiemckinstry.tech",
+		Name: name,
 	})
 	return res, err
 }
 
-func getSSHKeyId(ctx *pulumi.Context) (string, error) {
+func getSSHKeyId(ctx *pulumi.Context, name string) (string, error) {
 	fmt.Println("Fetching SSH Key.")
 	var sshLookupArgs = &digitalocean.LookupSshKeyArgs{
-		Name: sshKeyName,
+		Name: name,
 	}
 	sshKey, err := digitalocean.LookupSshKey(ctx, sshLookupArgs, nil)
 	if err != nil {
-		return "", nil
+		return "", fmt.Errorf("looking up SSH key %q: %w", name, err)
+	}
+	if sshKey.Id == 0 {
+		return "", fmt.Errorf("SSH key %q was not found in DigitalOcean", name)
 	}
 	var keyId = fmt.Sprintf("%d", sshKey.Id)
 	return keyId, nil
 }
 
-func chainCommand(ctx *pulumi.Context, name, cmd string, conn remote.ConnectionInput, prior pulumi.Resource) (*remote.Command, error) {
-	var deps = []pulumi.Resource{prior}
-	var opts = []pulumi.ResourceOption{pulumi.DependsOn(deps)}
-	var cmdResult, err = remote.NewCommand(ctx, name, &remote.CommandArgs{
-		Connection: conn,
-		Create:     pulumi.String(cmd),
+// ensureSSHKey returns the ID of the key droplets are created with. Given a
+// public key, it creates the key under name, so a fresh account works;
+// otherwise it looks up an existing key by name.
+func ensureSSHKey(ctx *pulumi.Context, name, publicKey string, opts ...pulumi.ResourceOption) (pulumi.StringInput, error) {
+	if publicKey == "" {
+		var keyId, err = getSSHKeyId(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		return pulumi.String(keyId), nil
+	}
+	fmt.Println("Creating SSH Key.")
+	var sshKey, err = digitalocean.NewSshKey(ctx, "rocket-ssh-key", &digitalocean.SshKeyArgs{
+		Name:      pulumi.String(name),
+		PublicKey: pulumi.String(publicKey),
 	}, opts...)
-	outputCmd(ctx, name, cmdResult)
-	return cmdResult, err
+	if err != nil {
+		return nil, err
+	}
+	return sshKey.ID().ToStringOutput(), nil
+}
+
+// chainCommand runs cmd on the host once everything in prior has completed.
+func chainCommand(ctx *pulumi.Context, name, cmd string, conn remote.ConnectionInput, options commandOptions, prior ...pulumi.Resource) (*remote.Command, error) {
+	return chainCommandWithDelete(ctx, name, cmd, "", conn, options, prior...)
+}
+
+// chainCommandWithDelete is chainCommand with a deleteCmd that undoes cmd on
+// `pulumi destroy`, or when the step is replaced. An empty deleteCmd leaves
+// the step as chainCommand would create it.
+func chainCommandWithDelete(ctx *pulumi.Context, name, cmd, deleteCmd string, conn remote.ConnectionInput, options commandOptions, prior ...pulumi.Resource) (*remote.Command, error) {
+	name = options.name(name)
+	var opts = options.resourceOpts(pulumi.DependsOn(prior))
+	var args = &remote.CommandArgs{
+		Connection: conn,
+		Create:     pulumi.String(options.wrap(cmd)),
+		Triggers:   options.Triggers,
+	}
+	if deleteCmd != "" {
+		args.Delete = pulumi.String(options.wrap(deleteCmd))
+		// Otherwise a replacement would run the old step's delete after the
+		// new one's create, undoing it.
+		opts = append(opts, pulumi.DeleteBeforeReplace(true))
+	}
+	var cmdResult, err = remote.NewCommand(ctx, name, args, opts...)
+	if err != nil {
+		return nil, err
+	}
+	outputCmd(options.Steps, name, cmdResult, prior...)
+	return cmdResult, nil
 }
 
-func chainLocal(ctx *pulumi.Context, name, cmd string, prior pulumi.Resource) (*local.Command, error) {
-	var deps = []pulumi.Resource{prior}
-	var opts = []pulumi.ResourceOption{pulumi.DependsOn(deps)}
+// chainLocal runs cmd locally once everything in prior has completed. Its
+// resource options come first since prior takes the variadic slot.
+func chainLocal(ctx *pulumi.Context, steps *provisioningSteps, name, cmd string, opts []pulumi.ResourceOption, prior ...pulumi.Resource) (*local.Command, error) {
+	opts = append(append([]pulumi.ResourceOption{}, opts...), pulumi.DependsOn(prior))
 	var cmdResult, err = local.NewCommand(ctx, name, &local.CommandArgs{
 		Create: pulumi.String(cmd),
 	}, opts...)
-	outputLocalCmd(ctx, name, cmdResult)
-	return cmdResult, err
+	if err != nil {
+		return nil, err
+	}
+	outputLocalCmd(steps, name, cmdResult, prior...)
+	return cmdResult, nil
+}
+
+func outputCmd(steps *provisioningSteps, name string, cmd *remote.Command, prior ...pulumi.Resource) {
+	steps.record(name, cmd.Stdout, cmd.Stderr, prior...)
 }
 
-func outputCmd(ctx *pulumi.Context, name string, cmd *remote.Command) {
-	var stdOutExport = fmt.Sprintf("%s-stdout", name)
-	var stdErrExport = fmt.Sprintf("%s-stderr", name)
-	ctx.Export(stdOutExport, cmd.Stdout)
-	ctx.Export(stdErrExport, cmd.Stderr)
+func outputLocalCmd(steps *provisioningSteps, name string, cmd *local.Command, prior ...pulumi.Resource) {
+	steps.record(name, cmd.Stdout, cmd.Stderr, prior...)
 }
 
-func outputLocalCmd(ctx *pulumi.Context, name string, cmd *local.Command) {
-	var stdOutExport = fmt.Sprintf("%s-stdout", name)
-	var stdErrExport = fmt.Sprintf("%s-stderr", name)
-	ctx.Export(stdOutExport, cmd.Stdout)
-	ctx.Export(stdErrExport, cmd.Stderr)
+// egressCheckScript only fails when no HTTP response comes back at all, since
+// registries commonly answer anonymous requests with a 401.
+func egressCheckScript(url string) string {
+	return fmt.Sprintf(`code=$(curl -s -o /dev/null -w '%%{http_code}' --max-time 10 '%[1]s')
+if [ "$code" = "000" ]; then
+	echo "droplet cannot reach %[1]s; check egress firewall rules before the image pull" >&2
+	exit 1
+fi
+echo "reached %[1]s (HTTP $code)"`, url)
 }
 
-func registerSystemdManifest(ctx *pulumi.Context, conn remote.ConnectionInput, copyRes pulumi.Resource) error {
+// firewallPorts are the ports opened on the droplet for the load balancer
+// to reach; forwarding rules may only target these.
+var firewallPorts = []int{80}
 
-	var whichDocker, err = chainCommand(ctx, "where-is-docker", "which docker", conn, copyRes)
-	if err != nil {
-		return err
+func firewallCommand(ports []int) string {
+	var cmds []string
+	for _, port := range ports {
+		cmds = append(cmds, ufwAllowCommand(port))
 	}
-	openFirewall, err := chainCommand(ctx, "open-firewall", "ufw allow 80", conn, whichDocker)
-	if err != nil {
-		return err
+	return strings.Join(cmds, " && ")
+}
+
+// ufwAllowCommand only adds the rule for port when ufw doesn't list it yet,
+// so re-runs neither duplicate it nor report a change that didn't happen.
+func ufwAllowCommand(port int) string {
+	return fmt.Sprintf(`{ ufw status | grep -qE '^%[1]d[[:space:]]' && echo "port %[1]d already allowed" || ufw allow %[1]d; }`, port)
+}
+
+// firewallCleanupCommand removes the rules firewallCommand added.
+func firewallCleanupCommand(ports []int) string {
+	var cmds []string
+	for _, port := range ports {
+		cmds = append(cmds, fmt.Sprintf("ufw delete allow %d", port))
 	}
+	return strings.Join(cmds, " && ")
+}
+
+// aptUpgradeScript brings the host's packages up to date without prompting.
+// At boot cloud-init may still hold the dpkg lock, so apt waits for it, and
+// the whole update is retried a few times before failing the step. The last
+// line says whether a reboot is now needed.
+const aptUpgradeScript = `export DEBIAN_FRONTEND=noninteractive
+for i in 1 2 3 4 5; do
+	apt-get -o DPkg::Lock::Timeout=120 update -q &&
+		apt-get -o DPkg::Lock::Timeout=120 -o Dpkg::Options::=--force-confdef -o Dpkg::Options::=--force-confold upgrade -y -q &&
+		break
+	if [ "$i" = 5 ]; then
+		echo "apt-get upgrade kept failing" >&2
+		exit 1
+	fi
+	echo "apt-get failed, retrying in 10s" >&2
+	sleep 10
+done
+if [ -f /var/run/reboot-required ]; then
+	echo "reboot-required: yes"
+else
+	echo "reboot-required: no"
+fi`
 
-	enableSystemd, err := chainCommand(ctx, "enable-systemd-manifest", "systemctl enable rocket.service", conn, openFirewall)
+// upgradePackages runs aptUpgradeScript and exports whether the host now
+// needs a reboot. It doesn't reboot; a pending reboot is logged as a warning.
+func upgradePackages(ctx *pulumi.Context, conn remote.ConnectionInput, options commandOptions, prior pulumi.Resource) (*remote.Command, error) {
+	fmt.Println("Upgrading packages.")
+	var upgrade, err = chainCommand(ctx, "upgrade-packages", options.privileged(aptUpgradeScript), conn, options, prior)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	var name = options.name("reboot-required")
+	ctx.Export(name, upgrade.Stdout.ApplyT(func(out string) bool {
+		var required = strings.HasSuffix(strings.TrimSpace(out), "reboot-required: yes")
+		if required {
+			ctx.Log.Warn(name+": the package upgrade needs a reboot to take full effect", nil)
+		}
+		return required
+	}))
+	return upgrade, nil
+}
+
+// dockerPinScript installs an exact docker-ce version and pins it, so neither
+// unattended upgrades nor a later apt-get upgrade can move it.
+func dockerPinScript(version string) string {
+	return fmt.Sprintf(`set -e
+export DEBIAN_FRONTEND=noninteractive
+cat > /etc/apt/preferences.d/docker-ce <<'EOF'
+Package: docker-ce docker-ce-cli
+Pin: version %[1]s
+Pin-Priority: 1001
+EOF
+apt-get update -q
+apt-get install -y -q --allow-downgrades docker-ce='%[1]s' docker-ce-cli='%[1]s'
+apt-mark hold docker-ce docker-ce-cli
+docker version --format '{{.Server.Version}}'`, version)
+}
+
+// swapFileScript creates, enables and persists a sizeMb swap file. It only
+// rebuilds the file when its size changes, and adds the fstab entry once, so
+// re-running it is harmless.
+func swapFileScript(sizeMb int) string {
+	return fmt.Sprintf(`set -e
+if [ -f /swapfile ] && [ "$(stat -c %%s /swapfile)" != "%[2]d" ]; then
+	swapoff /swapfile 2>/dev/null || true
+	rm -f /swapfile
+fi
+if [ ! -f /swapfile ]; then
+	fallocate -l %[1]dM /swapfile
+	chmod 600 /swapfile
+	mkswap /swapfile
+fi
+swapon --show=NAME --noheadings | grep -qx /swapfile || swapon /swapfile
+grep -q '^/swapfile ' /etc/fstab || echo '/swapfile none swap sw 0 0' >> /etc/fstab
+swapon --show`, sizeMb, sizeMb*1024*1024)
+}
+
+// swapFileCleanupScript undoes swapFileScript.
+const swapFileCleanupScript = `swapoff /swapfile 2>/dev/null || true
+rm -f /swapfile
+sed -i '\#^/swapfile #d' /etc/fstab`
+
+// registerSystemdManifest installs and starts the unit, or brings the compose
+// project up with the compose runtime, then waits for the service to answer.
+// It returns the deploy phase's start step and the final verify step.
+func registerSystemdManifest(ctx *pulumi.Context, conn remote.ConnectionInput, options commandOptions, cfg *appConfig, copyRes *remote.CopyFile, content pulumi.StringOutput) (*remote.Command, *remote.Command, error) {
+	var unit = cfg.Systemd.UnitFile()
+	// A change to the copied unit's content re-runs every step that loads it,
+	// so an edited unit is reloaded, restarted and checked rather than left
+	// on disk.
+	var reload = options
+	reload.Triggers = pulumi.Array{contentHash(content)}
+	var script = func(name, cmd string) phaseStep {
+		return scriptStep(ctx, conn, options, CommandStep{Name: name, Script: cmd})
 	}
-	_, err = chainCommand(ctx, "start-systemd-manifest", "systemctl start rocket.service", conn, enableSystemd)
+	// reversible steps are undone on destroy, so a reused host isn't left
+	// running the service or with its ports open.
+	var reversible = func(name, cmd, deleteCmd string, options commandOptions) phaseStep {
+		return phaseStep{name: name, create: func(prior pulumi.Resource) (*remote.Command, error) {
+			return chainCommandWithDelete(ctx, name, cmd, deleteCmd, conn, options, prior)
+		}}
+	}
+	var bootstrap, configure, deploy, verify []phaseStep
+	// Swap goes in first, so that docker never runs short of memory.
+	if cfg.SwapSizeMb > 0 {
+		bootstrap = append(bootstrap, reversible("create-swap-file", options.privileged(swapFileScript(cfg.SwapSizeMb)), options.privileged(swapFileCleanupScript), options))
+	}
+	// Packages are brought up to date before anything else is installed.
+	if cfg.AptUpgrade {
+		bootstrap = append(bootstrap, phaseStep{name: "upgrade-packages", create: func(prior pulumi.Resource) (*remote.Command, error) {
+			return upgradePackages(ctx, conn, options, prior)
+		}})
+	}
+	// Then fail2ban, since a fresh host's SSH port is probed within minutes.
+	if cfg.Harden {
+		bootstrap = append(bootstrap, phaseStep{name: "install-fail2ban", create: func(prior pulumi.Resource) (*remote.Command, error) {
+			return hardenSSH(ctx, conn, options, cfg, prior)
+		}})
+	}
+	if cfg.DockerVersion != "" {
+		bootstrap = append(bootstrap, script("pin-docker-version", options.privileged(dockerPinScript(cfg.DockerVersion))))
+	}
+	bootstrap = append(bootstrap, script("where-is-docker", "which docker"))
+	if cfg.Runtime == "compose" {
+		bootstrap = append(bootstrap, script("where-is-docker-compose", "docker compose version"))
+	}
+	// Only when egressCheckUrl is set, e.g. to the image registry's /v2/
+	// endpoint, so existing stacks don't gain a step on their next up.
+	if cfg.EgressCheckURL != "" {
+		bootstrap = append(bootstrap, script("check-egress", egressCheckScript(cfg.EgressCheckURL)))
+	}
+
+	// DigitalOcean droplets sit behind a cloud firewall instead; an existing
+	// host is only reachable through its own ufw.
+	if cfg.Provider == "ssh" {
+		configure = append(configure, reversible("open-firewall", options.privileged(firewallCommand(firewallPorts)), options.privileged(firewallCleanupCommand(firewallPorts)), options))
+	}
+	if cfg.Runtime != "compose" {
+		var enable = "systemctl daemon-reload && systemctl enable " + unit
+		if options.Sudo {
+			enable = fmt.Sprintf("install -m 0644 %s %s && %s", stagedUnitPath(cfg.Systemd), cfg.Systemd.UnitPath(), enable)
+		}
+		configure = append(configure, reversible("enable-systemd-manifest", options.privileged(enable), options.privileged("systemctl disable "+unit), reload))
+	}
+
+	// Log in right before the pull so a short-lived token can't expire first.
+	if cfg.RegistryAuth.enabled() {
+		deploy = append(deploy, phaseStep{name: "registry-login", create: func(prior pulumi.Resource) (*remote.Command, error) {
+			return refreshRegistryLogin(ctx, conn, options, cfg.RegistryAuth, prior)
+		}})
+	}
+	// reload-or-restart reloads a unit with an ExecReload, keeping in-flight
+	// connections, and restarts one without, such as rocket.service.
+	var startName, start = "start-systemd-manifest", "systemctl daemon-reload && systemctl reload-or-restart " + unit
+	var stopName, stop = "stop-systemd-manifest", "systemctl stop " + unit
+	if cfg.Runtime == "compose" {
+		startName, start = "compose-up", composeCommand(cfg.Systemd, "up -d --remove-orphans")
+		stopName, stop = "compose-down", composeCommand(cfg.Systemd, "down")
+		if options.Sudo {
+			start = fmt.Sprintf("install -D -m 0644 %s %s && %s", stagedComposePath(cfg.Systemd), composeFilePath(cfg.Systemd), start)
+		}
+	}
+	// The stop lives on a step of its own that unit changes don't trigger, so
+	// it only runs on destroy. On the triggered start step, a replacement
+	// would run it first and take every host down at once.
+	deploy = append(deploy, reversible(stopName, "true", options.privileged(stop), options))
+	var started *remote.Command
+	deploy = append(deploy, phaseStep{name: startName, create: func(prior pulumi.Resource) (*remote.Command, error) {
+		var err error
+		started, err = chainCommand(ctx, startName, options.privileged(start), conn, reload, prior)
+		return started, err
+	}})
+
+	verify = append(verify, phaseStep{name: "verify-service-health", create: func(prior pulumi.Resource) (*remote.Command, error) {
+		return verifyServiceHealth(ctx, conn, reload, cfg, prior)
+	}})
+
+	var phases = []provisioningPhase{
+		{name: "bootstrap", steps: bootstrap},
+		{name: "configure", steps: configure},
+		{name: "deploy", steps: deploy},
+		{name: "verify", steps: verify},
+	}
+	for i := range phases {
+		for _, step := range cfg.CustomSteps[phases[i].name] {
+			phases[i].steps = append(phases[i].steps, scriptStep(ctx, conn, options, step))
+		}
+	}
+	var finished, err = runPhases(ctx, options, phases, copyRes)
 	if err != nil {
-		return err
+		return nil, nil, err
+	}
+	return started, finished["verify"], nil
+}
+
+// contentHash is the SHA-256 of content, for triggers that should only fire
+// when a file's content changes.
+func contentHash(content pulumi.StringOutput) pulumi.StringOutput {
+	return content.ApplyT(func(content string) string {
+		var sum = sha256.Sum256([]byte(content))
+		return hex.EncodeToString(sum[:])
+	}).(pulumi.StringOutput)
+}
+
+// dropletSuffix names the index'th droplet's resources. The first droplet
+// keeps the names it had when only one was deployed.
+func dropletSuffix(index int) string {
+	if index == 0 {
+		return ""
+	}
+	return fmt.Sprintf("-%d", index+1)
+}
+
+// hostSuffix names the index'th host's resources, in the active slot when
+// deploying blue-green.
+func (c *appConfig) hostSuffix(index int) string {
+	if !c.BlueGreen {
+		return dropletSuffix(index)
+	}
+	return slotSuffix(c.ActiveSlot) + dropletSuffix(index)
+}
+
+// dropletNames are the droplets' names, one per host.
+func (c *appConfig) dropletNames() []string {
+	var names []string
+	for i := 0; i < c.DropletCount; i++ {
+		names = append(names, c.prefixed("rust-web")+c.hostSuffix(i))
+	}
+	return names
+}
+
+// prefixed puts NamePrefix in front of a resource or DNS name, so stacks that
+// share an account don't collide. Without a prefix, names are left as is.
+func (c *appConfig) prefixed(name string) string {
+	if c.NamePrefix == "" {
+		return name
+	}
+	return c.NamePrefix + "-" + name
+}
+
+// hostname is the site's name, on the stack's prefixed subdomain.
+func (c *appConfig) hostname() string {
+	return c.prefixed(siteSubdomain) + "." + c.Domain
+}
+
+// dropletSpec is what a droplet is created with, apart from its name.
+type dropletSpec struct {
+	KeyId  pulumi.StringInput
+	Region string
+	Size   string
+	Image  string
+	Tags   pulumi.StringArray
+	// ResizeInPlace ignores size changes here and leaves them to resizeDroplet.
+	ResizeInPlace bool
+	IPv6          bool
+	Backups       bool
+	// Monitoring installs the metrics agent that alert policies read from.
+	Monitoring bool
+	// UserData runs on first boot, when it is not nil, and the droplet is
+	// created in the VpcId VPC, when that isn't nil either. Changing either
+	// replaces the droplet.
+	UserData pulumi.StringInput
+	VpcId    pulumi.StringPtrInput
+}
+
+// createDroplets creates identical droplets, one per name, to be put behind
+// the LB.
+func createDroplets(ctx *pulumi.Context, names []string, spec dropletSpec, opts ...pulumi.ResourceOption) ([]*digitalocean.Droplet, error) {
+	var droplets []*digitalocean.Droplet
+	for _, name := range names {
+		var droplet, err = createDroplet(ctx, name, spec, opts...)
+		if err != nil {
+			return nil, err
+		}
+		droplets = append(droplets, droplet)
 	}
-	return err
+	return droplets, nil
 }
 
-func createDroplet(ctx *pulumi.Context, keyId string) (*digitalocean.Droplet, error) {
+// createDroplet creates one droplet as spec describes.
+func createDroplet(ctx *pulumi.Context, name string, spec dropletSpec, opts ...pulumi.ResourceOption) (*digitalocean.Droplet, error) {
 	fmt.Println("Creating Droplet.")
-	return digitalocean.NewDroplet(ctx, "rust-web", &digitalocean.DropletArgs{
-		Image:  pulumi.String("docker-20-04"),
-		Region: pulumi.String("nyc3"),
-		Size:   pulumi.String("s-1vcpu-1gb"),
+	// A size change would normally replace the droplet; when resizing in place
+	// we ignore it here and let resizeDroplet handle it instead.
+	var ignored []string
+	if spec.ResizeInPlace {
+		ignored = append(ignored, "size")
+	}
+	// Switching to a golden snapshot shouldn't replace a working droplet; the
+	// snapshot only applies to droplets created from here on. Snapshots are
+	// referred to by numeric ID, image slugs never are.
+	if _, err := strconv.Atoi(spec.Image); err == nil {
+		ignored = append(ignored, "image")
+	}
+	if len(ignored) > 0 {
+		opts = append(append([]pulumi.ResourceOption{}, opts...), pulumi.IgnoreChanges(ignored))
+	}
+	return digitalocean.NewDroplet(ctx, name, &digitalocean.DropletArgs{
+		Image:  pulumi.String(spec.Image),
+		Region: pulumi.String(spec.Region),
+		Size:   pulumi.String(spec.Size),
 		SshKeys: pulumi.StringArray{
-			pulumi.String(keyId),
+			spec.KeyId,
 		},
-	})
+		Tags:       spec.Tags,
+		Ipv6:       pulumi.Bool(spec.IPv6),
+		Backups:    pulumi.Bool(spec.Backups),
+		Monitoring: pulumi.Bool(spec.Monitoring),
+		UserData:   spec.UserData,
+		VpcUuid:    spec.VpcId,
+	}, opts...)
+}
+
+// healthProbeScript polls the service on the droplet itself up to attempts
+// times, interval seconds apart, failing the step unless it answers with
+// status, or with any 2xx when status is 0.
+func healthProbeScript(path string, status, attempts, interval int) string {
+	var pattern, want = "2??", "a 2xx"
+	if status != 0 {
+		pattern, want = strconv.Itoa(status), "HTTP "+strconv.Itoa(status)
+	}
+	return fmt.Sprintf(`for i in $(seq 1 %[4]d); do
+	code=$(curl -s -o /dev/null -w '%%{http_code}' --max-time 2 'http://localhost:80%[1]s')
+	case "$code" in
+	%[2]s)
+		echo "service healthy at %[1]s (HTTP $code)"
+		exit 0;;
+	esac
+	sleep %[5]d
+done
+echo "service never answered %[1]s with %[3]s (last HTTP $code)" >&2
+exit 1`, path, pattern, want, attempts, interval)
+}
+
+// verifyServiceHealth fails the update when the service on a host never
+// answers. The droplet is left in place for inspection; Pulumi can't replace
+// it partway through the update it was created in.
+func verifyServiceHealth(ctx *pulumi.Context, conn remote.ConnectionInput, options commandOptions, cfg *appConfig, started pulumi.Resource) (*remote.Command, error) {
+	fmt.Println("Waiting for the service to become healthy.")
+	var script = healthProbeScript(cfg.HealthPath, cfg.HealthStatus, cfg.HealthAttempts, cfg.HealthInterval)
+	return chainCommand(ctx, "verify-service-health", script, conn, options, started)
 }
 
-func openConnection(droplet *digitalocean.Droplet) (remote.ConnectionInput, error) {
-	var dropletHostname = droplet.Ipv4Address
-	var privateKey, err = ioutil.ReadFile(privateKeyPath)
+// pruneCommand removes stale image layers. "dangling" only removes untagged
+// layers left behind by re-pulls, while "all" removes every image no container
+// is using.
+func pruneCommand(policy, olderThan string) string {
+	var cmd = "docker image prune -f"
+	if policy == "all" {
+		cmd += " -a"
+	}
+	if olderThan != "" {
+		cmd += " --filter until=" + olderThan
+	}
+	return cmd
+}
+
+func pruneImages(ctx *pulumi.Context, conn remote.ConnectionInput, options commandOptions, policy, olderThan string, prior pulumi.Resource) (*remote.Command, error) {
+	fmt.Println("Pruning stale docker images.")
+	return chainCommand(ctx, "prune-docker-images", options.privileged(pruneCommand(policy, olderThan)), conn, options, prior)
+}
+
+// exportHostKeyFingerprint publishes the droplet's ed25519 host key
+// fingerprint so it can be pinned in known_hosts.
+func exportHostKeyFingerprint(ctx *pulumi.Context, conn remote.ConnectionInput, options commandOptions, prior pulumi.Resource) error {
+	var hostKey, err = chainCommand(ctx, "read-host-key", "ssh-keygen -lf /etc/ssh/ssh_host_ed25519_key.pub", conn, options, prior)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	// ssh-keygen prints "<bits> <fingerprint> <comment> (<type>)".
+	ctx.Export(options.name("ssh-host-key-fingerprint"), hostKey.Stdout.ApplyT(func(out string) string {
+		var fields = strings.Fields(out)
+		if len(fields) < 2 {
+			return ""
+		}
+		return fields[1]
+	}))
+	return nil
+}
+
+// numericId converts a resource ID into the integer form DigitalOcean's
+// LB expects. A malformed ID fails the output with a descriptive error rather
+// than a bare strconv one, and the assertion is checked instead of panicking.
+func numericId(id pulumi.IDOutput) (pulumi.IntOutput, error) {
+	var converted = id.ToStringOutput().ApplyT(func(val string) (int, error) {
+		var n, err = strconv.Atoi(val)
+		if err != nil {
+			return 0, fmt.Errorf("resource ID %q is not numeric: %w", val, err)
+		}
+		return n, nil
+	})
+	var intOutput, ok = converted.(pulumi.IntOutput)
+	if !ok {
+		return pulumi.IntOutput{}, fmt.Errorf("converting resource ID: expected pulumi.IntOutput, got %T", converted)
+	}
+	return intOutput, nil
+}
+
+// healthGatedId only resolves once healthy, the output of the health probe,
+// has, so the LB cannot attach the droplet before the app is ready to take
+// traffic.
+func healthGatedId(dropletId pulumi.IntOutput, healthy pulumi.StringOutput) pulumi.IntOutput {
+	return pulumi.All(dropletId, healthy).ApplyT(func(args []interface{}) int {
+		return args[0].(int)
+	}).(pulumi.IntOutput)
+}
+
+func (c *appConfig) siteURL(secure bool) string {
+	if !secure {
+		return "http://" + c.hostname()
+	}
+	return "https://" + c.hostname()
+}
+
+// openConnection leaves the default port 22 implicit, so that connections
+// made before the port was configurable don't change.
+func openConnection(droplet *digitalocean.Droplet, user string, port int, privateKey pulumi.StringInput) remote.ConnectionInput {
+	if port == 22 {
+		port = 0
+	}
+	return sshConnection(droplet.Ipv4Address, user, port, privateKey)
+}
+
+// stagedUnitPath is where the unit is copied when connected as a non-root
+// user, who can't write to the systemd directory directly.
+func stagedUnitPath(params SystemdParams) string {
+	return "/tmp/" + params.UnitFile()
+}
+
+// systemdUnit renders the unit once the image tag and digest are known. env
+// adds variables only known at deploy time, such as a database URI, to the
+// configured environment.
+func systemdUnit(params SystemdParams, imageTag, imageDigest pulumi.StringOutput, env pulumi.StringMap) pulumi.StringOutput {
+	return pulumi.All(imageTag, imageDigest, env.ToStringMapOutput()).ApplyT(func(args []interface{}) (string, error) {
+		var resolved, err = resolveSystemdParams(params, args[0].(string), args[1].(string), args[2].(map[string]string))
+		if err != nil {
+			return "", err
+		}
+		return renderSystemdUnit(resolved)
+	}).(pulumi.StringOutput)
+}
+
+// resolveSystemdParams fills in the values only known at deploy time and
+// validates the result.
+func resolveSystemdParams(params SystemdParams, imageTag, imageDigest string, env map[string]string) (SystemdParams, error) {
+	params.ImageTag = imageTag
+	params.ImageDigest = imageDigest
+	var merged = map[string]string{}
+	for key, value := range params.Environment {
+		merged[key] = value
+	}
+	for key, value := range env {
+		merged[key] = value
 	}
-	var conn = remote.ConnectionArgs{
-		Host:       dropletHostname,
-		User:       pulumi.String("root"),
-		PrivateKey: pulumi.String(privateKey),
+	params.Environment = merged
+	if err := params.validate(); err != nil {
+		return SystemdParams{}, err
 	}
-	return conn, nil
+	return params, nil
 }
 
-func copySystemdManifest(ctx *pulumi.Context, conn remote.ConnectionInput, waitOn pulumi.Resource) (*remote.CopyFile, error) {
+func copySystemdManifest(ctx *pulumi.Context, conn remote.ConnectionInput, options commandOptions, params SystemdParams, unit pulumi.StringOutput, hostReady pulumi.Resource) (*remote.CopyFile, error) {
 	fmt.Println("Copying Service file to droplet.")
-	var sleepResult, err = chainLocal(ctx, "sleep", "sleep 30", waitOn)
-	if err != nil {
-		return nil, err
+	var localPath = unit.ApplyT(func(unit string) (string, error) {
+		return writeSecretFile(params.UnitFile(), unit)
+	}).(pulumi.StringOutput)
+	var remotePath = params.UnitPath()
+	if options.Sudo {
+		remotePath = stagedUnitPath(params)
 	}
-	var deps = []pulumi.Resource{sleepResult}
-	var opts = []pulumi.ResourceOption{pulumi.DependsOn(deps)}
-	res, err := remote.NewCopyFile(ctx, "copy-systemd-file", &remote.CopyFileArgs{
+	var deps = []pulumi.Resource{hostReady}
+	var opts = options.resourceOpts(pulumi.DependsOn(deps))
+	var res, err = remote.NewCopyFile(ctx, options.name("copy-systemd-file"), &remote.CopyFileArgs{
 		Connection: conn,
-		LocalPath:  pulumi.String("rocket.service"),
-		RemotePath: pulumi.String(initFilePath),
-		Triggers:   nil,
+		LocalPath:  localPath,
+		RemotePath: pulumi.String(remotePath),
+		// LocalPath stays the same across runs, so re-copy on content changes.
+		Triggers: pulumi.Array{unit},
 	}, opts...)
-	return res, err
+	if err != nil {
+		return nil, err
+	}
+	removeAfterCopy(res, localPath)
+	return res, nil
 }
 
 func main() {
 
-	// • Push container to container registry?
 	// • Create a sample Service file (check Cacher for example)
 	// • Copy file to Droplet.
 	// • Exec remote commands to start the Service.
-	pulumi.Run(func(ctx *pulumi.Context) error {
-		// • Import my SSH Key from DigitalOcean
-		//   so I can copy files to the Droplet.
-		var keyId, err = getSSHKeyId(ctx)
-		if err != nil {
-			return err
+	pulumi.Run(deploy)
+}
+
+// setupDeploy loads the config, emits the deploy plan when asked to, and
+// starts the deadline for the program's own blocking calls. The caller
+// cancels the deadline once it is done with them.
+func setupDeploy(ctx *pulumi.Context) (*appConfig, context.Context, context.CancelFunc, error) {
+	var cfg, err = loadConfig(ctx)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	// • Describe the deploy for review, and stop there if asked to.
+	if cfg.PlanOnly || cfg.PlanFile != "" {
+		if err := emitDeployPlan(ctx, buildDeployPlan(cfg, ctx.Stack()), cfg.PlanFile); err != nil {
+			return nil, nil, nil, err
 		}
-		// • Grab the domain so I can add a new DNS record.
-		domain, err := lookupDomain(ctx)
-		if err != nil {
-			return err
+		// Returning nil here would look like an empty program and delete
+		// the whole stack; an error stops the update with nothing changed.
+		if cfg.PlanOnly {
+			return nil, nil, nil, fmt.Errorf("planOnly is set; stopping after the deploy plan")
 		}
+	}
+	// • Bound how long the deploy's own lookups may take.
+	var deadline, cancel = startDeployDeadline(cfg.DeployTimeout)
+	return cfg, deadline, cancel, nil
+}
 
-		// • Create the Droplet itself, assigning my ssh key.
-		droplet, err := createDroplet(ctx, keyId)
-		if err != nil {
-			return err
-		}
+// deploy declares the whole stack: the config-driven WebApp and the locks,
+// scans, tests and outputs around it.
+func deploy(ctx *pulumi.Context) error {
+	var cfg, deadline, stopDeadline, err = setupDeploy(ctx)
+	if err != nil {
+		return err
+	}
+	defer stopDeadline()
 
-		// • Create a Let's Encrypt certificate
-		cert, err := digitalocean.NewCertificate(ctx, "cert", &digitalocean.CertificateArgs{
-			Domains: pulumi.StringArray{
-				pulumi.String("pulumi.robbiemckinstry.tech"),
-			},
-			Type: pulumi.String("lets_encrypt"),
-		})
+	// steps collects the commands reported in provisioningResults.
+	var steps provisioningSteps
+
+	// • Refuse to run alongside another deploy of this stack.
+	var lock *deployLock
+	var hostDeps []pulumi.Resource
+	if cfg.DeployLock {
+		lock, err = acquireDeployLock(ctx, cfg.Domain, cfg.lockRecordName(), cfg.DeployLockTTL)
 		if err != nil {
 			return err
 		}
-
-		// • Throw together a load balancer for the new droplet.
-		var conversionCallback = func(val string) (int, error) {
-			return strconv.Atoi(val)
-		}
-		var dropletId = droplet.ID().ToStringOutput().ApplyT(conversionCallback).(pulumi.IntOutput)
-		lb, err := digitalocean.NewLoadBalancer(ctx, "rocket-lb", &digitalocean.LoadBalancerArgs{
-			Region:                       pulumi.String("nyc3"),
-			Name:                         pulumi.String("rocket-lb"),
-			RedirectHttpToHttps:          pulumi.BoolPtr(true),
-			DisableLetsEncryptDnsRecords: pulumi.BoolPtr(true),
-			ForwardingRules: digitalocean.LoadBalancerForwardingRuleArray{
-				&digitalocean.LoadBalancerForwardingRuleArgs{
-					EntryPort:      pulumi.Int(80),
-					EntryProtocol:  pulumi.String("http"),
-					TargetPort:     pulumi.Int(80),
-					TargetProtocol: pulumi.String("http"),
-				},
-				&digitalocean.LoadBalancerForwardingRuleArgs{
-					CertificateName: cert.Name,
-					EntryPort:       pulumi.Int(443),
-					EntryProtocol:   pulumi.String("https"),
-					TargetPort:      pulumi.Int(80),
-					TargetProtocol:  pulumi.String("http"),
-				},
-			},
-			DropletIds: pulumi.IntArray{
-				dropletId,
-			},
-		})
+		hostDeps = append(hostDeps, lock.acquire)
+	}
+	// • Work out which image tag this deploy ships.
+	imageTag, err := resolveImageTag(ctx, cfg.ImageTagFromGit, cfg.Systemd.ImageTag)
+	if err != nil {
+		return err
+	}
+	ctx.Export("image-tag", imageTag)
+	// • Build and push the image, and deploy exactly that build.
+	var imageDigest = pulumi.String("").ToStringOutput()
+	if cfg.BuildImage {
+		cfg.Systemd.Image, imageDigest, err = buildAndPushImage(ctx, cfg.RegistryName, cfg.Systemd.Image, imageTag, cfg.BuildContext)
 		if err != nil {
 			return err
 		}
-		ctx.Export("address", droplet.Ipv4Address)
-		ctx.Export("lb-address", lb.Ip)
-		ctx.Export("url", pulumi.String("https://pulumi.robbiemckinstry.tech"))
-
-		// • Create a new DNS record at "pulumi.robbiemckinstry.tech"
-		_, err = digitalocean.NewDnsRecord(ctx, "pulumi-dns", &digitalocean.DnsRecordArgs{
-			Domain: pulumi.String(domain.Id),
-			Name:   pulumi.String("pulumi"),
-			Type:   pulumi.String("A"),
-			Value:  lb.Ip,
-		})
+	}
+	var imageRef = pulumi.All(imageTag, imageDigest).ApplyT(func(args []interface{}) string {
+		var params = cfg.Systemd
+		params.ImageTag = args[0].(string)
+		params.ImageDigest = args[1].(string)
+		return params.ImageRef()
+	}).(pulumi.StringOutput)
+	// • Refuse to deploy an image with known vulnerabilities.
+	if cfg.ScanImage {
+		scan, err := scanImage(ctx, cfg.Scanner, imageRef, cfg.ScanSeverity, &steps)
 		if err != nil {
 			return err
 		}
+		hostDeps = append(hostDeps, scan)
+	}
 
-		// • Create the connection details using provided creds.
-		conn, err := openConnection(droplet)
+	// • Stand up the app: host, systemd provisioning, LB and DNS.
+	app, err := NewWebApp(ctx, "rocket", &WebAppArgs{
+		Domain:             siteDomain,
+		Region:             cfg.Region,
+		Size:               cfg.Size,
+		Image:              cfg.Systemd.Image,
+		ServiceName:        cfg.Systemd.Name,
+		SSHSourceAddresses: cfg.SSHSourceAddresses,
+		BootTimeout:        cfg.BootTimeout,
+		ImageTag:           imageTag,
+		ImageDigest:        imageDigest,
+		config:             cfg,
+		deadline:           deadline,
+		hostDeps:           hostDeps,
+		steps:              &steps,
+	})
+	if err != nil {
+		return err
+	}
+	var exposure = app.exposure
+	var changeTriggers = app.changeTriggers
+	var lastSteps = app.lastSteps
+	ctx.Export("address", app.DropletIP)
+	ctx.Export("addresses", app.DropletIPs)
+	ctx.Export("url", app.URL)
+	// • Print the command that logs in to the first host, through its
+	//   reserved IP when it has one.
+	var sshAddress = app.DropletIP
+	if reserved, ok := exposure.Outputs["reservedIp"]; ok {
+		sshAddress = reserved.ToStringOutput()
+	}
+	ctx.Export("ssh", cfg.sshCommand(sshAddress))
+	// • Optionally mirror the key outputs into a sourceable .env file.
+	if cfg.EnvFilePath != "" {
+		var envOutputs = map[string]pulumi.StringInput{
+			"ip":  app.DropletIP,
+			"url": pulumi.String(exposure.URL),
+		}
+		for name, value := range exposure.Outputs {
+			envOutputs[name] = value
+		}
+		_, err = writeEnvFile(ctx, cfg.EnvFilePath, cfg.EnvFileKeys, envOutputs)
 		if err != nil {
 			return err
 		}
-		// • Copy over the Systemd manifest.
-		copyOutput, err := copySystemdManifest(ctx, conn, droplet)
+	}
+
+	// • Run the team's own integration suite against the live URL.
+	if cfg.IntegrationTestPath != "" {
+		var deps = append(append([]pulumi.Resource{}, lastSteps...), exposure.Resources...)
+		integration, err := runIntegrationTests(ctx, cfg.IntegrationTestPath, exposure.URL, cfg.IntegrationTestToken, changeTriggers, deps, &steps)
 		if err != nil {
 			return err
 		}
-		// • Register the manifest with Systemd and launch it.
-		err = registerSystemdManifest(ctx, conn, copyOutput)
+		lastSteps = []pulumi.Resource{integration}
+	}
+
+	if lock != nil {
+		err = lock.release(ctx, lastSteps...)
 		if err != nil {
 			return err
 		}
-		return nil
-	})
+	}
+	// • Tell CI whether this run actually changed anything.
+	exportDeployment(ctx, app, exportProvisioningResults(ctx, steps))
+	exportCommands(ctx, steps)
+	return exportDeployChanged(ctx, changeTriggers)
 }
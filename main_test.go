@@ -0,0 +1,467 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pulumi/pulumi-command/sdk/go/command/remote"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/resource"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+const (
+	testProject = "do-example"
+	testStack   = "dev"
+	testLBIP    = "203.0.113.10"
+)
+
+// mocks stands in for the engine and the DigitalOcean API. It answers the
+// lookups deploy makes, failing those listed in failing, and keeps every
+// resource registered so tests can check what was created.
+type mocks struct {
+	mu        sync.Mutex
+	resources []pulumi.MockResourceArgs
+	droplets  int
+	// withoutAddress leaves droplets without an IPv4 address, as before
+	// DigitalOcean has assigned one.
+	withoutAddress bool
+	// calls lists the token of each lookup made, in order.
+	calls []string
+	// failing maps an invoke token to the error it fails with.
+	failing map[string]error
+	// records maps a DNS record name to the data a lookup finds in it.
+	records map[string]string
+}
+
+func (m *mocks) NewResource(args pulumi.MockResourceArgs) (string, resource.PropertyMap, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.resources = append(m.resources, args)
+	var id, state = args.Name + "-id", args.Inputs.Copy()
+	switch args.TypeToken {
+	case "digitalocean:index/droplet:Droplet":
+		m.droplets++
+		// Droplet IDs are numeric; the LB and firewall parse them.
+		id = fmt.Sprint(1000 + m.droplets)
+		if !m.withoutAddress {
+			state["ipv4Address"] = resource.NewStringProperty(fmt.Sprintf("192.0.2.%d", m.droplets))
+		}
+	case "digitalocean:index/loadBalancer:LoadBalancer":
+		state["ip"] = resource.NewStringProperty(testLBIP)
+	case "digitalocean:index/certificate:Certificate":
+		id = "cert-uuid"
+		if _, ok := state["name"]; !ok {
+			state["name"] = resource.NewStringProperty(args.Name)
+		}
+	case "command:local:Command":
+		if args.Name == "deploy-changed-marker" {
+			state["stdout"] = resource.NewStringProperty(fmt.Sprint(time.Now().Unix()))
+		}
+	}
+	return id, state, nil
+}
+
+func (m *mocks) Call(args pulumi.MockCallArgs) (resource.PropertyMap, error) {
+	m.mu.Lock()
+	m.calls = append(m.calls, args.Token)
+	m.mu.Unlock()
+	if err, ok := m.failing[args.Token]; ok {
+		return nil, err
+	}
+	var out = args.Args.Copy()
+	switch args.Token {
+	case "digitalocean:index/getSshKey:getSshKey":
+		out["id"] = resource.NewNumberProperty(42)
+	case "digitalocean:index/getDomain:getDomain":
+		out["id"] = args.Args["name"]
+		out["ttl"] = resource.NewNumberProperty(1800)
+	case "digitalocean:index/getRecord:getRecord":
+		out["id"] = resource.NewStringProperty("lookup-id")
+		out["data"] = resource.NewStringProperty(m.records[args.Args["name"].StringValue()])
+	default:
+		out["id"] = resource.NewStringProperty("lookup-id")
+	}
+	return out, nil
+}
+
+// created returns the inputs of each resource of type typ, by name.
+func (m *mocks) created(typ string) map[string]resource.PropertyMap {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var found = map[string]resource.PropertyMap{}
+	for _, res := range m.resources {
+		if res.TypeToken == typ {
+			found[res.Name] = res.Inputs
+		}
+	}
+	return found
+}
+
+// only returns the name and inputs of the single resource of type typ,
+// failing the test unless there is exactly one.
+func (m *mocks) only(t *testing.T, typ string) (string, resource.PropertyMap) {
+	t.Helper()
+	var res = m.registered(t, typ)
+	return res.Name, res.Inputs
+}
+
+// registered returns the full registration of the single resource of type
+// typ, including the dependencies the engine was told about.
+func (m *mocks) registered(t *testing.T, typ string) pulumi.MockResourceArgs {
+	t.Helper()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var found []pulumi.MockResourceArgs
+	for _, res := range m.resources {
+		if res.TypeToken == typ {
+			found = append(found, res)
+		}
+	}
+	if len(found) != 1 {
+		t.Fatalf("want one %s, got %d", typ, len(found))
+	}
+	return found[0]
+}
+
+// testPrivateKey is a throwaway key for the provisioning connection.
+func testPrivateKey(t *testing.T) string {
+	t.Helper()
+	var key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}))
+}
+
+// runDeploy runs deploy against m with the stack config set to conf, on top
+// of an inline private key.
+func runDeploy(t *testing.T, m *mocks, conf map[string]string) error {
+	t.Helper()
+	var all = map[string]string{testProject + ":privateKey": testPrivateKey(t)}
+	for key, value := range conf {
+		all[testProject+":"+key] = value
+	}
+	var encoded, err = json.Marshal(all)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PULUMI_CONFIG", string(encoded))
+	return pulumi.RunErr(deploy, pulumi.WithMocks(testProject, testStack, m))
+}
+
+func TestDeployCreatesDropletsBehindLoadBalancer(t *testing.T) {
+	var m = &mocks{}
+	if err := runDeploy(t, m, map[string]string{
+		"region":       "sfo3",
+		"size":         "s-2vcpu-2gb",
+		"dropletCount": "2",
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	var droplets = m.created("digitalocean:index/droplet:Droplet")
+	if len(droplets) != 2 {
+		t.Fatalf("want 2 droplets, got %d", len(droplets))
+	}
+	for name, droplet := range droplets {
+		if got := droplet["region"].StringValue(); got != "sfo3" {
+			t.Errorf("droplet %s: region = %q, want sfo3", name, got)
+		}
+		if got := droplet["size"].StringValue(); got != "s-2vcpu-2gb" {
+			t.Errorf("droplet %s: size = %q, want s-2vcpu-2gb", name, got)
+		}
+	}
+
+	var _, lb = m.only(t, "digitalocean:index/loadBalancer:LoadBalancer")
+	var ids []float64
+	for _, id := range lb["dropletIds"].ArrayValue() {
+		ids = append(ids, id.NumberValue())
+	}
+	if fmt.Sprint(ids) != "[1001 1002]" {
+		t.Errorf("LB dropletIds = %v, want [1001 1002]", ids)
+	}
+
+	var ports = map[string]string{}
+	for _, rule := range lb["forwardingRules"].ArrayValue() {
+		var rule = rule.ObjectValue()
+		ports[rule["entryProtocol"].StringValue()] = fmt.Sprintf("%v->%v",
+			rule["entryPort"].NumberValue(), rule["targetPort"].NumberValue())
+	}
+	if ports["http"] != "80->80" || ports["https"] != "443->80" {
+		t.Errorf("LB forwarding rules = %v, want http 80->80 and https 443->80", ports)
+	}
+
+	var records = m.created("digitalocean:index/dnsRecord:DnsRecord")
+	var found bool
+	for name, record := range records {
+		if record["type"].StringValue() != "A" || record["name"].StringValue() != siteSubdomain {
+			continue
+		}
+		found = true
+		if got := record["value"].StringValue(); got != testLBIP {
+			t.Errorf("A record %s points at %q, want the LB's %s", name, got, testLBIP)
+		}
+	}
+	if !found {
+		t.Errorf("no A record for %q among %d records", siteSubdomain, len(records))
+	}
+}
+
+func TestDeployReturnsLookupErrors(t *testing.T) {
+	var m = &mocks{failing: map[string]error{
+		"digitalocean:index/getSshKey:getSshKey": errors.New("GET https://api.digitalocean.com/v2/account/keys: 503 Service Unavailable"),
+	}}
+	var err = runDeploy(t, m, nil)
+	if err == nil || !strings.Contains(err.Error(), "503 Service Unavailable") {
+		t.Fatalf("want the lookup's error, got %v", err)
+	}
+	if droplets := m.created("digitalocean:index/droplet:Droplet"); len(droplets) != 0 {
+		t.Errorf("created %d droplets after the lookup failed", len(droplets))
+	}
+}
+
+func TestLoadBalancerDependsOnCertificate(t *testing.T) {
+	var m = &mocks{}
+	if err := runDeploy(t, m, nil); err != nil {
+		t.Fatal(err)
+	}
+	var certName, _ = m.only(t, "digitalocean:index/certificate:Certificate")
+	var lb = m.registered(t, "digitalocean:index/loadBalancer:LoadBalancer")
+	var found bool
+	for _, dep := range lb.RegisterRPC.GetDependencies() {
+		found = found || strings.HasSuffix(dep, "::"+certName)
+	}
+	if !found {
+		t.Errorf("LB dependencies %v don't include certificate %q", lb.RegisterRPC.GetDependencies(), certName)
+	}
+	var usesCert bool
+	for _, rule := range lb.Inputs["forwardingRules"].ArrayValue() {
+		var name = rule.ObjectValue()["certificateName"]
+		usesCert = usesCert || (name.IsString() && name.StringValue() == certName)
+	}
+	if !usesCert {
+		t.Errorf("no LB forwarding rule terminates TLS with certificate %q", certName)
+	}
+}
+
+func TestNamePrefix(t *testing.T) {
+	var m = &mocks{}
+	if err := runDeploy(t, m, map[string]string{
+		"namePrefix":   "blue",
+		"sshPublicKey": "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIHQ7 deploy@example",
+		"database":     `{"enabled": true}`,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for name := range m.created("digitalocean:index/droplet:Droplet") {
+		if name != "blue-rust-web" {
+			t.Errorf("droplet is named %q, want blue-rust-web", name)
+		}
+	}
+	var names = map[string]string{
+		"digitalocean:index/loadBalancer:LoadBalancer":       "blue-rocket-lb",
+		"digitalocean:index/databaseCluster:DatabaseCluster": "blue-rocket-db",
+		"digitalocean:index/sshKey:SshKey":                   "blue-" + defaultSSHKeyName,
+	}
+	for typ, want := range names {
+		var _, inputs = m.only(t, typ)
+		if got := inputs["name"].StringValue(); got != want {
+			t.Errorf("%s is named %q, want %q", typ, got, want)
+		}
+	}
+}
+
+// resolve runs build against m and returns the value its output resolves
+// to, or the error that stopped it.
+func resolve(m *mocks, build func(ctx *pulumi.Context) (pulumi.Input, error)) (interface{}, error) {
+	var value interface{}
+	var err = pulumi.RunErr(func(ctx *pulumi.Context) error {
+		var in, err = build(ctx)
+		if err != nil {
+			return err
+		}
+		ctx.Export("value", pulumi.ToOutput(in).ApplyT(func(v interface{}) interface{} {
+			value = v
+			return v
+		}))
+		return nil
+	}, pulumi.WithMocks(testProject, testStack, m))
+	return value, err
+}
+
+func TestEnsureSSHKey(t *testing.T) {
+	const publicKey = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIHQ7 deploy@example"
+	t.Run("creates the key when given one", func(t *testing.T) {
+		var m = &mocks{}
+		var id, err = resolve(m, func(ctx *pulumi.Context) (pulumi.Input, error) {
+			return ensureSSHKey(ctx, "deploy", publicKey)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var name, key = m.only(t, "digitalocean:index/sshKey:SshKey")
+		if id != name+"-id" {
+			t.Errorf("ID = %v, want the created key's %s-id", id, name)
+		}
+		if key["name"].StringValue() != "deploy" || key["publicKey"].StringValue() != publicKey {
+			t.Errorf("created key %v, want deploy with the given public key", key)
+		}
+		if len(m.calls) != 0 {
+			t.Errorf("looked up %v as well as creating the key", m.calls)
+		}
+	})
+	t.Run("looks up an existing key otherwise", func(t *testing.T) {
+		var m = &mocks{}
+		var id, err = resolve(m, func(ctx *pulumi.Context) (pulumi.Input, error) {
+			return ensureSSHKey(ctx, "deploy", "")
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id != "42" {
+			t.Errorf("ID = %v, want the looked-up 42", id)
+		}
+		if keys := m.created("digitalocean:index/sshKey:SshKey"); len(keys) != 0 {
+			t.Errorf("created %d keys instead of looking one up", len(keys))
+		}
+	})
+}
+
+func TestGetSSHKeyIdReturnsLookupErrors(t *testing.T) {
+	var lookupErr = errors.New("401 Unable to authenticate you")
+	var m = &mocks{failing: map[string]error{
+		"digitalocean:index/getSshKey:getSshKey": lookupErr,
+	}}
+	var err = pulumi.RunErr(func(ctx *pulumi.Context) error {
+		var _, err = getSSHKeyId(ctx, "deploy")
+		return err
+	}, pulumi.WithMocks(testProject, testStack, m))
+	if err == nil {
+		t.Fatal("want the lookup's error, got none")
+	}
+	for _, want := range []string{`SSH key "deploy"`, lookupErr.Error()} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q doesn't mention %s", err, want)
+		}
+	}
+}
+
+func TestNumericId(t *testing.T) {
+	var tests = []struct {
+		id      string
+		want    int
+		wantErr string
+	}{
+		{id: "301478913", want: 301478913},
+		{id: "0", want: 0},
+		{id: "cert-uuid", wantErr: `resource ID "cert-uuid" is not numeric`},
+		{id: "", wantErr: `resource ID "" is not numeric`},
+		{id: "12abc", wantErr: `resource ID "12abc" is not numeric`},
+	}
+	for _, tt := range tests {
+		var got, err = resolve(&mocks{}, func(ctx *pulumi.Context) (pulumi.Input, error) {
+			return numericId(pulumi.ID(tt.id).ToIDOutput())
+		})
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("numericId(%q): error = %v, want %q", tt.id, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("numericId(%q) = %v, %v; want %d", tt.id, got, err, tt.want)
+		}
+	}
+}
+
+func TestChainCommandWithDelete(t *testing.T) {
+	var tests = []struct {
+		name, deleteCmd string
+	}{
+		{name: "with a delete command", deleteCmd: "rm -f /etc/rocket.conf"},
+		{name: "without one", deleteCmd: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var m = &mocks{}
+			var err = pulumi.RunErr(func(ctx *pulumi.Context) error {
+				var conn = remote.ConnectionArgs{Host: pulumi.String("192.0.2.1")}
+				var _, err = chainCommandWithDelete(ctx, "write-conf", "touch /etc/rocket.conf", tt.deleteCmd, conn, commandOptions{})
+				return err
+			}, pulumi.WithMocks(testProject, testStack, m))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var cmd = m.registered(t, "command:remote:Command")
+			var del, hasDelete = cmd.Inputs["delete"]
+			if tt.deleteCmd == "" {
+				if hasDelete || cmd.RegisterRPC.GetDeleteBeforeReplace() {
+					t.Errorf("delete = %v, deleteBeforeReplace = %v; want neither", del, cmd.RegisterRPC.GetDeleteBeforeReplace())
+				}
+				return
+			}
+			if !hasDelete || del.StringValue() != tt.deleteCmd {
+				t.Errorf("delete = %v, want %q", del, tt.deleteCmd)
+			}
+			if !cmd.RegisterRPC.GetDeleteBeforeReplace() {
+				t.Error("a step with a delete command must be deleted before it is replaced")
+			}
+		})
+	}
+}
+
+func TestContentHash(t *testing.T) {
+	var hash = func(content string) interface{} {
+		t.Helper()
+		var sum, err = resolve(&mocks{}, func(ctx *pulumi.Context) (pulumi.Input, error) {
+			return contentHash(pulumi.String(content).ToStringOutput()), nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sum
+	}
+	var unit = "[Service]\nExecStart=/usr/bin/docker run rocket:v1\n"
+	if hash(unit) != hash(unit) {
+		t.Error("the same content hashed differently")
+	}
+	if hash(unit) == hash(strings.Replace(unit, "v1", "v2", 1)) {
+		t.Error("changed content kept the same hash")
+	}
+}
+
+func TestUnitChangeRetriggersStart(t *testing.T) {
+	var startTriggers = func(imageTag string) string {
+		t.Helper()
+		var m = &mocks{}
+		if err := runDeploy(t, m, map[string]string{"imageTag": imageTag}); err != nil {
+			t.Fatal(err)
+		}
+		var start, ok = m.created("command:remote:Command")["start-systemd-manifest"]
+		if !ok {
+			t.Fatal("no start-systemd-manifest command")
+		}
+		return fmt.Sprint(start["triggers"])
+	}
+	var before, after = startTriggers("v1"), startTriggers("v2")
+	if before == after {
+		t.Errorf("start-systemd-manifest triggers %s didn't change with the unit", before)
+	}
+	if again := startTriggers("v1"); again != before {
+		t.Errorf("the same unit gave triggers %s, then %s", before, again)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pulumi/pulumi-command/sdk/go/command/remote"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+// Provisioning runs in these phases, in order. Custom steps from the
+// "customSteps" config run at the end of the phase they are listed under.
+var provisioningPhaseNames = []string{"bootstrap", "configure", "deploy", "verify"}
+
+// phaseStep declares one step of a phase once the step before it exists.
+type phaseStep struct {
+	name   string
+	create func(prior pulumi.Resource) (*remote.Command, error)
+}
+
+type provisioningPhase struct {
+	name  string
+	steps []phaseStep
+}
+
+func scriptStep(ctx *pulumi.Context, conn remote.ConnectionInput, options commandOptions, step CommandStep) phaseStep {
+	return phaseStep{name: step.Name, create: func(prior pulumi.Resource) (*remote.Command, error) {
+		return chainStep(ctx, step, conn, options, prior)
+	}}
+}
+
+// builtinStepNames are the remote commands the program declares on each host
+// itself. A custom step can't reuse one, or both would get the same URN.
+var builtinStepNames = []string{
+	"create-swap-file", "upgrade-packages", "install-fail2ban", "pin-docker-version",
+	"where-is-docker", "where-is-docker-compose", "check-egress", "open-firewall",
+	"enable-systemd-manifest", "registry-login", "stop-systemd-manifest",
+	"start-systemd-manifest", "compose-down", "compose-up", "verify-service-health",
+	"prune-docker-images", "read-host-key", "create-caddy-dir", "open-caddy-firewall",
+	"start-caddy", "create-compose-dir",
+}
+
+func validateCustomSteps(custom map[string][]CommandStep, sidecars []SidecarParams) error {
+	var taken = map[string]string{}
+	for _, name := range builtinStepNames {
+		taken[name] = "a built-in step"
+	}
+	for _, sidecar := range sidecars {
+		taken["start-"+sidecar.Name] = fmt.Sprintf("sidecar %q's start step", sidecar.Name)
+	}
+	for _, phase := range provisioningPhaseNames {
+		for _, step := range custom[phase] {
+			if clash, ok := taken[step.Name]; ok {
+				return fmt.Errorf("customSteps: step name %q is already used by %s", step.Name, clash)
+			}
+			if step.Name != "" {
+				taken[step.Name] = "another custom step"
+			}
+		}
+	}
+	for phase, steps := range custom {
+		if !containsString(provisioningPhaseNames, phase) {
+			return fmt.Errorf("customSteps: unknown phase %q, expected one of %s", phase, strings.Join(provisioningPhaseNames, ", "))
+		}
+		for _, step := range steps {
+			if step.Name == "" || step.Script == "" {
+				return fmt.Errorf("customSteps: each %s step needs a name and a script", phase)
+			}
+			if err := step.validate(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// runPhases chains every step of every phase after prior and returns the
+// step each phase finished on. It exports provisioningPhases, mapping each
+// phase to its steps, so a failed update's resource name can be traced back
+// to the phase it failed in.
+func runPhases(ctx *pulumi.Context, options commandOptions, phases []provisioningPhase, prior pulumi.Resource) (map[string]*remote.Command, error) {
+	var finished = map[string]*remote.Command{}
+	var summary = pulumi.Map{}
+	for _, phase := range phases {
+		var names pulumi.StringArray
+		for _, step := range phase.steps {
+			var cmd, err = step.create(prior)
+			if err != nil {
+				return nil, fmt.Errorf("%s phase, step %q: %w", phase.name, step.name, err)
+			}
+			names = append(names, pulumi.String(step.name))
+			finished[phase.name] = cmd
+			prior = cmd
+		}
+		summary[phase.name] = names
+	}
+	ctx.Export(options.name("provisioningPhases"), summary)
+	return finished, nil
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateCustomStepsRejectsTakenNames(t *testing.T) {
+	var sidecars = []SidecarParams{cadvisorSidecar}
+	var tests = []struct {
+		steps   map[string][]CommandStep
+		wantErr string
+	}{
+		{steps: map[string][]CommandStep{"deploy": {{Name: "migrate", Script: "./migrate"}}}},
+		{
+			steps:   map[string][]CommandStep{"verify": {{Name: "start-systemd-manifest", Script: "true"}}},
+			wantErr: `"start-systemd-manifest" is already used by a built-in step`,
+		},
+		{
+			steps:   map[string][]CommandStep{"bootstrap": {{Name: "start-cadvisor", Script: "true"}}},
+			wantErr: `sidecar "cadvisor"`,
+		},
+		{
+			steps: map[string][]CommandStep{
+				"configure": {{Name: "seed", Script: "./seed"}},
+				"verify":    {{Name: "seed", Script: "./seed --check"}},
+			},
+			wantErr: `"seed" is already used by another custom step`,
+		},
+	}
+	for _, tt := range tests {
+		var err = validateCustomSteps(tt.steps, sidecars)
+		if tt.wantErr == "" {
+			if err != nil {
+				t.Errorf("validateCustomSteps(%v) = %v, want nil", tt.steps, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("validateCustomSteps(%v) = %v, want %q", tt.steps, err, tt.wantErr)
+		}
+	}
+}
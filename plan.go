@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+// plannedDatabase names the database the app is given.
+type plannedDatabase struct {
+	Cluster  string `json:"cluster"`
+	Database string `json:"database"`
+	User     string `json:"user"`
+}
+
+// deployPlan is a reviewer-facing summary of what a deploy intends to do. It
+// is built from the resolved config alone, so it describes intent; the
+// resources themselves, and how they change, are what `pulumi preview` shows.
+type deployPlan struct {
+	Stack        string           `json:"stack"`
+	Provider     string           `json:"provider"`
+	Region       string           `json:"region,omitempty"`
+	Image        string           `json:"image"`
+	Size         string           `json:"size,omitempty"`
+	Count        int              `json:"count"`
+	Droplets     []string         `json:"droplets,omitempty"`
+	Tags         []string         `json:"tags,omitempty"`
+	URL          string           `json:"url"`
+	LoadBalancer bool             `json:"loadBalancer"`
+	Certificates []string         `json:"certificates,omitempty"`
+	Database     *plannedDatabase `json:"database,omitempty"`
+}
+
+func buildDeployPlan(cfg *appConfig, stack string) deployPlan {
+	var plan = deployPlan{
+		Stack:    stack,
+		Provider: cfg.Provider,
+		Image:    cfg.Systemd.ImageRef(),
+		Count:    cfg.DropletCount,
+		Tags:     cfg.Tags,
+	}
+	switch {
+	case cfg.UseCaddy:
+		plan.URL = cfg.siteURL(true)
+	case cfg.Provider == "ssh":
+		plan.URL = "http://" + cfg.SSHTarget.Host
+	default:
+		plan.URL = cfg.siteURL(cfg.EnableCertificate)
+	}
+	if cfg.BuildImage {
+		// The digest is only known once the image is pushed.
+		plan.Image = registryImage(cfg.RegistryName, cfg.Systemd.Image)
+	}
+	if cfg.Provider != "digitalocean" {
+		return plan
+	}
+	plan.Region = cfg.Region
+	plan.Size = cfg.Size
+	plan.Droplets = cfg.dropletNames()
+	plan.Tags = append([]string{stackTag(stack)}, cfg.Tags...)
+	// Caddy terminates TLS on the droplet, so there's neither an LB nor a
+	// DigitalOcean certificate.
+	plan.LoadBalancer = !cfg.UseCaddy
+	if plan.LoadBalancer && cfg.EnableCertificate {
+		for _, spec := range cfg.Certificates {
+			plan.Certificates = append(plan.Certificates, spec.Name)
+		}
+	}
+	if cfg.Database.Enabled {
+		plan.Database = &plannedDatabase{
+			Cluster:  cfg.Database.Name,
+			Database: cfg.Database.Database,
+			User:     cfg.Database.User,
+		}
+	}
+	return plan
+}
+
+// emitDeployPlan logs the plan and, when path is set, writes it there too.
+func emitDeployPlan(ctx *pulumi.Context, plan deployPlan, path string) error {
+	var body, err = json.MarshalIndent(plan, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ctx.Log.Info(string(body), nil); err != nil {
+		return err
+	}
+	if path == "" {
+		return nil
+	}
+	fmt.Println("Writing deploy plan to", path)
+	return os.WriteFile(path, append(body, '\n'), 0o644)
+}
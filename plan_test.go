@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// readPlan runs deploy with planFile set and returns the plan it wrote.
+func readPlan(t *testing.T, m *mocks, conf map[string]string) deployPlan {
+	t.Helper()
+	var path = filepath.Join(t.TempDir(), "plan.json")
+	var all = map[string]string{"planFile": path}
+	for key, value := range conf {
+		all[key] = value
+	}
+	if err := runDeploy(t, m, all); err != nil {
+		t.Fatal(err)
+	}
+	var body, err = os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var plan deployPlan
+	if err := json.Unmarshal(body, &plan); err != nil {
+		t.Fatal(err)
+	}
+	return plan
+}
+
+func TestDeployPlanMatchesTheDeploy(t *testing.T) {
+	var m = &mocks{}
+	var plan = readPlan(t, m, map[string]string{
+		"namePrefix":   "blue",
+		"dropletCount": "2",
+		"database":     `{"enabled": true}`,
+	})
+	var droplets []string
+	for name := range m.created("digitalocean:index/droplet:Droplet") {
+		droplets = append(droplets, name)
+	}
+	sort.Strings(droplets)
+	if !reflect.DeepEqual(plan.Droplets, droplets) {
+		t.Errorf("plan droplets %v, deploy created %v", plan.Droplets, droplets)
+	}
+	if !plan.LoadBalancer {
+		t.Error("plan leaves out the load balancer the deploy created")
+	}
+	var certName, _ = m.only(t, "digitalocean:index/certificate:Certificate")
+	if !reflect.DeepEqual(plan.Certificates, []string{certName}) {
+		t.Errorf("plan certificates %v, deploy created %s", plan.Certificates, certName)
+	}
+	var _, cluster = m.only(t, "digitalocean:index/databaseCluster:DatabaseCluster")
+	var _, user = m.only(t, "digitalocean:index/databaseUser:DatabaseUser")
+	var _, db = m.only(t, "digitalocean:index/databaseDb:DatabaseDb")
+	var want = plannedDatabase{
+		Cluster:  cluster["name"].StringValue(),
+		Database: db["name"].StringValue(),
+		User:     user["name"].StringValue(),
+	}
+	if plan.Database == nil || *plan.Database != want {
+		t.Errorf("plan database %+v, want %+v", plan.Database, want)
+	}
+}
+
+func TestDeployPlanWithCaddyHasNoLoadBalancer(t *testing.T) {
+	var m = &mocks{}
+	var plan = readPlan(t, m, map[string]string{"useCaddy": "true"})
+	if plan.LoadBalancer || len(plan.Certificates) > 0 {
+		t.Errorf("plan has a load balancer %v and certificates %v with useCaddy", plan.LoadBalancer, plan.Certificates)
+	}
+	if lbs := m.created("digitalocean:index/loadBalancer:LoadBalancer"); len(lbs) != 0 {
+		t.Errorf("deploy created %d load balancers with useCaddy", len(lbs))
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/pulumi/pulumi-digitalocean/sdk/v4/go/digitalocean"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+// projectSpec groups the stack's resources under a DigitalOcean project, so
+// they can be found and billed apart from other stacks' in the console.
+type projectSpec struct {
+	Name        string `json:"name"`
+	Purpose     string `json:"purpose"`
+	Environment string `json:"environment"`
+	Description string `json:"description"`
+}
+
+func (p projectSpec) enabled() bool {
+	return p.Name != ""
+}
+
+func (p projectSpec) validate() error {
+	switch p.Environment {
+	case "", "Development", "Staging", "Production":
+		return nil
+	default:
+		return fmt.Errorf("project.environment must be Development, Staging or Production, got %q", p.Environment)
+	}
+}
+
+// createProject assigns the resources, given by their DigitalOcean URNs, to
+// the project. A resource belongs to one project at a time, so assigning it
+// here moves it out of the account's default project.
+func createProject(ctx *pulumi.Context, spec projectSpec, resources pulumi.StringArray, opts ...pulumi.ResourceOption) (*digitalocean.Project, error) {
+	fmt.Println("Grouping resources under project", spec.Name)
+	var args = &digitalocean.ProjectArgs{
+		Name:      pulumi.String(spec.Name),
+		Purpose:   pulumi.String(spec.Purpose),
+		Resources: resources,
+	}
+	if spec.Environment != "" {
+		args.Environment = pulumi.StringPtr(spec.Environment)
+	}
+	if spec.Description != "" {
+		args.Description = pulumi.StringPtr(spec.Description)
+	}
+	var project, err = digitalocean.NewProject(ctx, "rocket-project", args, opts...)
+	if err != nil {
+		return nil, err
+	}
+	ctx.Export("project-id", project.ID())
+	return project, nil
+}
@@ -0,0 +1,482 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/pulumi/pulumi-command/sdk/go/command/local"
+	"github.com/pulumi/pulumi-command/sdk/go/command/remote"
+	"github.com/pulumi/pulumi-digitalocean/sdk/v4/go/digitalocean"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+// Provider supplies the machines the provisioning flow (copy the unit, run it
+// under systemd) targets, and routes traffic to them once they are healthy.
+type Provider interface {
+	// CreateHosts creates or describes the machines. Nothing on them is
+	// touched before deps have completed.
+	CreateHosts(ctx *pulumi.Context, deps []pulumi.Resource) ([]*Host, error)
+	// Expose makes the provisioned service reachable. healthy holds each
+	// host's final health check, in the same order as hosts, or nil for a
+	// host that provisioned itself.
+	Expose(ctx *pulumi.Context, hosts []*Host, healthy []*remote.Command) (*Exposure, error)
+}
+
+// Host is a machine ready to be provisioned over SSH.
+type Host struct {
+	// ID is the droplet ID, or empty for a machine the provider didn't create.
+	ID      pulumi.StringOutput
+	Address pulumi.StringOutput
+	// Port is the SSH port, or 0 for the default.
+	Port int
+	Conn remote.ConnectionInput
+	// Ready completes once the machine can be provisioned.
+	Ready pulumi.Resource
+	// ChangeTriggers are the IDs that change when the machine is replaced.
+	ChangeTriggers pulumi.Array
+	// Metadata holds the droplet's region, size, monthly price and creation
+	// time, or is nil for a machine the provider didn't create.
+	Metadata pulumi.Map
+}
+
+// Exposure describes how the service is reached once it is exposed.
+type Exposure struct {
+	URL string
+	// Resources are what must exist before the URL routes to the service.
+	Resources []pulumi.Resource
+	// Outputs holds additional named outputs, such as the LB's IP.
+	Outputs        map[string]pulumi.StringInput
+	ChangeTriggers pulumi.Array
+}
+
+// sshTarget is an existing machine reachable over SSH.
+type sshTarget struct {
+	Host           string `json:"host"`
+	User           string `json:"user"`
+	Port           int    `json:"port"`
+	PrivateKeyPath string `json:"privateKeyPath"`
+}
+
+// newProvider returns the configured provider. userData, when not nil, is
+// cloud-init user data for the machines it creates, and vpcId the VPC they
+// are created in. opts apply to every resource it creates, e.g. to parent
+// them under a component.
+func newProvider(cfg *appConfig, deadline context.Context, userData pulumi.StringInput, vpcId pulumi.StringPtrInput, steps *provisioningSteps, opts ...pulumi.ResourceOption) (Provider, error) {
+	switch cfg.Provider {
+	case "digitalocean":
+		return &digitalOceanProvider{cfg: cfg, deadline: deadline, userData: userData, vpcId: vpcId, steps: steps, opts: opts}, nil
+	case "ssh":
+		return &sshProvider{cfg: cfg, opts: opts}, nil
+	default:
+		return nil, fmt.Errorf("provider must be digitalocean or ssh, got %q", cfg.Provider)
+	}
+}
+
+func sshConnection(host pulumi.StringInput, user string, port int, privateKey pulumi.StringInput) remote.ConnectionInput {
+	var conn = remote.ConnectionArgs{
+		Host:       host,
+		User:       pulumi.String(user),
+		PrivateKey: privateKey,
+	}
+	if port != 0 {
+		conn.Port = pulumi.Float64Ptr(float64(port))
+	}
+	return conn
+}
+
+type digitalOceanProvider struct {
+	cfg      *appConfig
+	deadline context.Context
+	userData pulumi.StringInput
+	vpcId    pulumi.StringPtrInput
+	steps    *provisioningSteps
+	opts     []pulumi.ResourceOption
+	droplets []*digitalocean.Droplet
+}
+
+func (p *digitalOceanProvider) CreateHosts(ctx *pulumi.Context, deps []pulumi.Resource) ([]*Host, error) {
+	// • Import my SSH Key from DigitalOcean, or create it,
+	//   so I can copy files to the Droplet.
+	var publicKey, err = p.cfg.sshPublicKey()
+	if err != nil {
+		return nil, err
+	}
+	// A key this stack uploads is its own, so it gets the prefix; an
+	// existing one is looked up by the name it already has.
+	var keyName = p.cfg.SSHKeyName
+	if publicKey != "" {
+		keyName = p.cfg.prefixed(keyName)
+	}
+	keyId, err := ensureSSHKey(ctx, keyName, publicKey, p.opts...)
+	if err != nil {
+		return nil, err
+	}
+	// • Make sure the droplet's tags exist, even when shared with other stacks.
+	//   The stack's own tag comes first, then the configured ones.
+	var tagNames = append([]string{stackTag(ctx.Stack())}, p.cfg.Tags...)
+	tags, err := ensureTags(ctx, p.deadline, tagNames, p.opts...)
+	if err != nil {
+		return nil, err
+	}
+	ctx.Export("tags", tags)
+	// • Create the Droplets themselves, assigning my ssh key.
+	var opts = append([]pulumi.ResourceOption{}, p.opts...)
+	if len(deps) > 0 {
+		opts = append(opts, pulumi.DependsOn(deps))
+	}
+	if p.cfg.protected(ctx.Stack()) {
+		opts = append(opts, pulumi.Protect(true))
+	}
+	image, err := dropletImage(ctx, p.cfg.DropletImage, p.cfg.CreateGoldenSnapshot)
+	if err != nil {
+		return nil, err
+	}
+	p.droplets, err = createDroplets(ctx, p.cfg.dropletNames(), dropletSpec{
+		KeyId:         keyId,
+		Region:        p.cfg.Region,
+		Size:          p.cfg.Size,
+		Image:         image,
+		Tags:          tags,
+		ResizeInPlace: p.cfg.ResizeInPlace,
+		IPv6:          p.cfg.EnableIPv6,
+		Backups:       p.cfg.Backups,
+		Monitoring:    p.cfg.Alerts.Enabled,
+		UserData:      p.userData,
+		VpcId:         p.vpcId,
+	}, opts...)
+	if err != nil {
+		return nil, err
+	}
+	// • Create the connection details using provided creds.
+	privateKey, err := p.cfg.sshPrivateKey()
+	if err != nil {
+		return nil, err
+	}
+	// • Alert when the droplets run hot.
+	if p.cfg.Alerts.Enabled {
+		var ids pulumi.StringArray
+		for _, droplet := range p.droplets {
+			ids = append(ids, droplet.ID().ToStringOutput())
+		}
+		if err := createAlerts(ctx, p.cfg.Alerts, ids, p.opts...); err != nil {
+			return nil, err
+		}
+	}
+	var hosts []*Host
+	var dropletIds pulumi.IntArray
+	var ready []pulumi.Resource
+	for i, droplet := range p.droplets {
+		var host = &Host{
+			ID:             droplet.ID().ToStringOutput(),
+			Address:        droplet.Ipv4Address,
+			Port:           p.cfg.SSHPort,
+			Conn:           openConnection(droplet, p.cfg.SSHUser, p.cfg.SSHPort, privateKey),
+			Ready:          droplet,
+			ChangeTriggers: pulumi.Array{droplet.ID()},
+			Metadata: pulumi.Map{
+				"region":       droplet.Region,
+				"size":         droplet.Size,
+				"priceMonthly": droplet.PriceMonthly,
+				"createdAt":    droplet.CreatedAt,
+			},
+		}
+		if p.vpcId != nil {
+			ctx.Export("private-address"+p.cfg.hostSuffix(i), droplet.Ipv4AddressPrivate)
+		}
+		// • Resize the Droplet in place when its size config changes.
+		if p.cfg.ResizeInPlace {
+			resize, err := resizeDroplet(ctx, "resize-droplet"+p.cfg.hostSuffix(i), droplet, p.cfg.Size, p.steps, p.opts...)
+			if err != nil {
+				return nil, err
+			}
+			host.Ready = resize
+			host.ChangeTriggers = append(host.ChangeTriggers, resize.ID())
+		}
+		dropletId, err := numericId(droplet.ID())
+		if err != nil {
+			return nil, err
+		}
+		dropletIds = append(dropletIds, dropletId)
+		ready = append(ready, host.Ready)
+		hosts = append(hosts, host)
+	}
+	// • Put the droplets behind a cloud firewall before provisioning them.
+	firewall, err := createFirewall(ctx, p.cfg.prefixed("rocket-firewall"), dropletIds, tags[:1], p.cfg.SSHPort, p.cfg.SSHSourceAddresses, p.cfg.HTTP3 && p.cfg.UseCaddy, p.cfg.EgressRules, append(p.opts, pulumi.DependsOn(ready))...)
+	if err != nil {
+		return nil, err
+	}
+	for _, host := range hosts {
+		host.Ready = firewall
+	}
+	return hosts, nil
+}
+
+func (p *digitalOceanProvider) Expose(ctx *pulumi.Context, hosts []*Host, healthy []*remote.Command) (*Exposure, error) {
+	// • Snapshot the first healthy droplet as the base image for future ones.
+	if p.cfg.CreateGoldenSnapshot {
+		if _, err := createGoldenSnapshot(ctx, p.droplets[0], healthy[0], p.opts...); err != nil {
+			return nil, err
+		}
+	}
+	// • Take an on-demand snapshot of the first droplet, once provisioned.
+	if p.cfg.SnapshotLabel != "" {
+		var ready pulumi.Resource = p.droplets[0]
+		if healthy[0] != nil {
+			ready = healthy[0]
+		}
+		if _, err := createDropletSnapshot(ctx, p.droplets[0], p.cfg.SnapshotLabel, ready, p.opts...); err != nil {
+			return nil, err
+		}
+	}
+	// • Grab the domain so I can add a new DNS record.
+	var domain, err = lookupDomain(ctx, p.cfg.Domain)
+	if err != nil {
+		return nil, err
+	}
+
+	// • Create a Let's Encrypt certificate and a load balancer for the
+	//   new droplets, unless Caddy is terminating TLS on the droplet itself.
+	var exposure = &Exposure{Outputs: map[string]pulumi.StringInput{}}
+	var rules []forwardingRule
+	var dnsTarget = hosts[0].Address
+	var projectResources = pulumi.StringArray{pulumi.String(domain.DomainUrn)}
+	for _, droplet := range p.droplets {
+		projectResources = append(projectResources, droplet.DropletUrn)
+	}
+	// • Give the first droplet an address that survives it being replaced.
+	if p.cfg.ReservedIP {
+		dropletId, err := numericId(p.droplets[0].ID())
+		if err != nil {
+			return nil, err
+		}
+		var opts = p.opts
+		if p.cfg.protected(ctx.Stack()) {
+			opts = append(append([]pulumi.ResourceOption{}, p.opts...), pulumi.Protect(true))
+		}
+		reserved, err := createReservedIp(ctx, p.cfg.Region, dropletId, opts...)
+		if err != nil {
+			return nil, err
+		}
+		exposure.Outputs["reservedIp"] = reserved.IpAddress
+		projectResources = append(projectResources, reserved.FloatingIpUrn)
+		exposure.ChangeTriggers = append(exposure.ChangeTriggers, reserved.ID())
+		dnsTarget = reserved.IpAddress
+	}
+	var certs map[string]*digitalocean.Certificate
+	if !p.cfg.UseCaddy {
+		if p.cfg.HTTP3 {
+			ctx.Log.Warn("http3 is only served in Caddy mode; the load balancer will not offer it", nil)
+		}
+		var httpsRules []httpsRule
+		if p.cfg.EnableCertificate {
+			certs, err = createCertificates(ctx, p.deadline, p.cfg.Certificates, p.cfg.ReuseCertificates, p.cfg.CheckDomainReachable, p.opts...)
+			if err != nil {
+				return nil, err
+			}
+			httpsRules, err = resolveHttpsRules(p.cfg.HttpsRules, certs)
+			if err != nil {
+				return nil, err
+			}
+		}
+		// • Forward what forwardingRules lists, or else port 80 plus an
+		//   https rule per httpsRules entry.
+		rules = buildForwardingRules(httpsRules, p.cfg.HTTP2)
+		if len(p.cfg.ForwardingRules) > 0 {
+			rules = attachCertificates(resolveForwardingRules(p.cfg.ForwardingRules, p.cfg.hostname()), certs)
+		}
+
+		var dropletIds pulumi.IntArray
+		var deps []pulumi.Resource
+		for i, droplet := range p.droplets {
+			dropletId, err := numericId(droplet.ID())
+			if err != nil {
+				return nil, err
+			}
+			// A self-provisioned droplet is attached right away; the LB's own
+			// health check keeps traffic off it until the service answers.
+			if healthy[i] == nil {
+				dropletIds = append(dropletIds, dropletId)
+				continue
+			}
+			// • In a blue-green deploy, check the new droplet from outside too
+			//   before the LB moves onto it.
+			if p.cfg.BlueGreen {
+				gate, err := gateCutover(ctx, "cutover-check"+p.cfg.hostSuffix(i), hosts[i].Address, p.cfg.HealthPath, healthy[i], p.steps, p.opts...)
+				if err != nil {
+					return nil, err
+				}
+				dropletIds = append(dropletIds, healthGatedId(dropletId, gate.Stdout))
+				deps = append(deps, gate)
+				continue
+			}
+			dropletIds = append(dropletIds, healthGatedId(dropletId, healthy[i].Stdout))
+			deps = append(deps, healthy[i])
+		}
+		lb, err := createLoadBalancer(ctx, p.cfg.prefixed("rocket-lb"), p.cfg.Region, dropletIds, rules, p.cfg.LBHealthcheck, p.cfg.LBStickySessions, p.cfg.LBSizing, p.cfg.ProxyProtocol, deps, p.opts...)
+		if err != nil {
+			return nil, err
+		}
+		ctx.Export("lb-address", lb.Ip)
+		exposure.Outputs["lbIp"] = lb.Ip
+		exposure.Resources = append(exposure.Resources, lb)
+		projectResources = append(projectResources, lb.LoadBalancerUrn)
+		exposure.ChangeTriggers = append(exposure.ChangeTriggers, lb.ID())
+		dnsTarget = lb.Ip
+	}
+	exposure.URL = p.cfg.siteURL(p.cfg.UseCaddy || servesTLS(rules))
+
+	// • Remember where the record points now, in case the cutover fails.
+	var priorIp string
+	if p.cfg.RollbackDNS {
+		priorIp, err = priorDnsValue(ctx, domain.Name, p.cfg.prefixed(siteSubdomain))
+		if err != nil {
+			return nil, err
+		}
+	}
+	// • Create a new DNS record at "pulumi.robbiemckinstry.tech"
+	record, err := digitalocean.NewDnsRecord(ctx, "pulumi-dns", &digitalocean.DnsRecordArgs{
+		Domain: pulumi.String(domain.Id),
+		Name:   pulumi.String(p.cfg.prefixed(siteSubdomain)),
+		Type:   pulumi.String("A"),
+		Value:  requireIPv4(dnsTarget),
+		Ttl:    pulumi.Int(p.cfg.DNSTTL),
+	}, p.opts...)
+	if err != nil {
+		return nil, err
+	}
+	exposure.Resources = append(exposure.Resources, record)
+	// • Alias extra names, such as www, to the record.
+	if p.cfg.EnableDNSAliases {
+		var names []string
+		for _, alias := range p.cfg.DNSAliases {
+			names = append(names, p.cfg.prefixed(alias))
+		}
+		aliases, err := createDnsAliases(ctx, domain.Id, names, p.cfg.DNSTTL, record, p.opts...)
+		if err != nil {
+			return nil, err
+		}
+		exposure.Resources = append(exposure.Resources, aliases...)
+	}
+	// • Serve IPv6 clients straight from the droplet, where Caddy has TLS.
+	if p.cfg.EnableIPv6 {
+		ctx.Export("ipv6-address", p.droplets[0].Ipv6Address)
+		aaaa, err := digitalocean.NewDnsRecord(ctx, "pulumi-dns-aaaa", &digitalocean.DnsRecordArgs{
+			Domain: pulumi.String(domain.Id),
+			Name:   pulumi.String(p.cfg.prefixed(siteSubdomain)),
+			Type:   pulumi.String("AAAA"),
+			Value:  p.droplets[0].Ipv6Address,
+			Ttl:    pulumi.Int(p.cfg.DNSTTL),
+		}, p.opts...)
+		if err != nil {
+			return nil, err
+		}
+		exposure.Outputs["ipv6"] = p.droplets[0].Ipv6Address
+		exposure.Resources = append(exposure.Resources, aaaa)
+	}
+	// • Point the record back if the site doesn't answer after the cutover.
+	if priorIp != "" {
+		guard, err := guardDnsCutover(ctx, record, p.cfg.hostname(), domain.Name, priorIp, exposure.URL+p.cfg.HealthPath, p.steps, p.opts...)
+		if err != nil {
+			return nil, err
+		}
+		exposure.Resources = append(exposure.Resources, guard)
+	}
+	// • Serve static assets from a Spaces bucket, behind the CDN.
+	if p.cfg.StaticAssets.Enabled {
+		var assets = p.cfg.StaticAssets
+		assets.Subdomain = p.cfg.prefixed(assets.Subdomain)
+		bucket, err := createStaticAssets(ctx, assets, domain, certs, p.cfg.DNSTTL, p.opts...)
+		if err != nil {
+			return nil, err
+		}
+		projectResources = append(projectResources, bucket.BucketUrn)
+	}
+	// • Keep the stack's resources together in their own project.
+	if p.cfg.Project.enabled() {
+		if _, err := createProject(ctx, p.cfg.Project, projectResources, p.opts...); err != nil {
+			return nil, err
+		}
+	}
+	return exposure, nil
+}
+
+// sshProvider provisions a machine that already exists, creating no cloud
+// resources at all.
+type sshProvider struct {
+	cfg  *appConfig
+	opts []pulumi.ResourceOption
+}
+
+func (p *sshProvider) CreateHosts(ctx *pulumi.Context, deps []pulumi.Resource) ([]*Host, error) {
+	fmt.Println("Using existing host", p.cfg.SSHTarget.Host)
+	var target = p.cfg.SSHTarget
+	var privateKey, err = p.cfg.sshPrivateKey()
+	if err != nil {
+		return nil, err
+	}
+	var conn = sshConnection(pulumi.String(target.Host), target.User, target.Port, privateKey)
+	// The marker stands in for the machine in the resource graph, so that
+	// provisioning has something to wait on and re-runs if the target moves.
+	var opts = append([]pulumi.ResourceOption{}, p.opts...)
+	if len(deps) > 0 {
+		opts = append(opts, pulumi.DependsOn(deps))
+	}
+	marker, err := local.NewCommand(ctx, "ssh-target", &local.CommandArgs{
+		Create:   pulumi.String("echo " + target.Host),
+		Triggers: pulumi.Array{pulumi.String(target.Host), pulumi.String(target.User)},
+	}, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return []*Host{{
+		ID:             pulumi.String("").ToStringOutput(),
+		Address:        pulumi.String(target.Host).ToStringOutput(),
+		Port:           target.Port,
+		Conn:           conn,
+		Ready:          marker,
+		ChangeTriggers: pulumi.Array{marker.ID()},
+	}}, nil
+}
+
+func (p *sshProvider) Expose(ctx *pulumi.Context, hosts []*Host, healthy []*remote.Command) (*Exposure, error) {
+	var url = "http://" + p.cfg.SSHTarget.Host
+	if p.cfg.UseCaddy {
+		url = p.cfg.siteURL(true)
+	}
+	return &Exposure{URL: url, Outputs: map[string]pulumi.StringInput{}}, nil
+}
+
+// createDnsAliases points a CNAME for each alias at the record. They wait for
+// the record, so an alias never resolves to a name that doesn't exist yet.
+func createDnsAliases(ctx *pulumi.Context, domainId string, aliases []string, ttl int, record *digitalocean.DnsRecord, opts ...pulumi.ResourceOption) ([]pulumi.Resource, error) {
+	var created []pulumi.Resource
+	for _, alias := range aliases {
+		var cname, err = digitalocean.NewDnsRecord(ctx, "pulumi-dns-cname-"+alias, &digitalocean.DnsRecordArgs{
+			Domain: pulumi.String(domainId),
+			Name:   pulumi.String(alias),
+			Type:   pulumi.String("CNAME"),
+			Ttl:    pulumi.Int(ttl),
+			// DigitalOcean reads a CNAME value without the trailing dot as
+			// relative to the domain.
+			Value: pulumi.Sprintf("%s.", record.Fqdn),
+		}, append(opts, pulumi.DependsOn([]pulumi.Resource{record}))...)
+		if err != nil {
+			return nil, err
+		}
+		created = append(created, cname)
+	}
+	return created, nil
+}
+
+// requireIPv4 fails the output unless it resolves to a valid IPv4 address, so
+// an LB that came up without an IP can't produce an empty A record.
+func requireIPv4(ip pulumi.StringOutput) pulumi.StringOutput {
+	return ip.ApplyT(func(ip string) (string, error) {
+		var parsed = net.ParseIP(ip)
+		if ip == "" || parsed == nil || parsed.To4() == nil {
+			return "", fmt.Errorf("refusing to create the A record: %q is not a valid IPv4 address", ip)
+		}
+		return ip, nil
+	}).(pulumi.StringOutput)
+}
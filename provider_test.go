@@ -0,0 +1,53 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/pulumi/pulumi-digitalocean/sdk/v4/go/digitalocean"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+func TestRequireIPv4(t *testing.T) {
+	var tests = []struct {
+		ip      string
+		wantErr bool
+	}{
+		{ip: "203.0.113.10"},
+		{ip: "", wantErr: true},
+		{ip: "2001:db8::1", wantErr: true},
+		{ip: "pending", wantErr: true},
+	}
+	for _, tt := range tests {
+		var got, err = resolve(&mocks{}, func(ctx *pulumi.Context) (pulumi.Input, error) {
+			return requireIPv4(pulumi.String(tt.ip).ToStringOutput()), nil
+		})
+		if tt.wantErr {
+			if err == nil || !strings.Contains(err.Error(), "refusing to create the A record") {
+				t.Errorf("requireIPv4(%q): error = %v, want a refusal", tt.ip, err)
+			}
+			continue
+		}
+		if err != nil || got != tt.ip {
+			t.Errorf("requireIPv4(%q) = %v, %v; want it unchanged", tt.ip, got, err)
+		}
+	}
+}
+
+func TestRequireIPv4RejectsMissingDropletIP(t *testing.T) {
+	var m = &mocks{withoutAddress: true}
+	var _, err = resolve(m, func(ctx *pulumi.Context) (pulumi.Input, error) {
+		var droplet, err = digitalocean.NewDroplet(ctx, "rust-web", &digitalocean.DropletArgs{
+			Image:  pulumi.String(defaultDropletImage),
+			Region: pulumi.String(defaultRegion),
+			Size:   pulumi.String("s-1vcpu-1gb"),
+		})
+		if err != nil {
+			return nil, err
+		}
+		return requireIPv4(droplet.Ipv4Address), nil
+	})
+	if err == nil || !strings.Contains(err.Error(), `"" is not a valid IPv4 address`) {
+		t.Fatalf("want a refusal for the missing address, got %v", err)
+	}
+}
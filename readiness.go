@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/pulumi/pulumi-command/sdk/go/command/local"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+// sshReadyScript polls until sshd answers with its banner, which a bare open
+// port doesn't guarantee while the droplet is still booting.
+const sshReadyScript = `deadline=$(( $(date +%s) + TIMEOUT ))
+until [ "$(timeout 5 bash -c 'exec 3<>/dev/tcp/$HOST/$PORT && head -c 4 <&3' 2>/dev/null)" = "SSH-" ]; do
+	if [ "$(date +%s)" -ge "$deadline" ]; then
+		echo "sshd on $HOST:$PORT not ready after ${TIMEOUT}s" >&2
+		exit 1
+	fi
+	sleep 2
+done
+echo "sshd ready on $HOST:$PORT"`
+
+// waitForSSH replaces a fixed boot sleep: provisioning starts as soon as the
+// host accepts SSH, and fails if it doesn't within timeout.
+func waitForSSH(ctx *pulumi.Context, address pulumi.StringOutput, port int, timeout time.Duration, options commandOptions, prior pulumi.Resource) (*local.Command, error) {
+	fmt.Println("Waiting for SSH on the host.")
+	if port == 0 {
+		port = 22
+	}
+	var cmdResult, err = local.NewCommand(ctx, options.name("wait-for-ssh"), &local.CommandArgs{
+		Create:      pulumi.String(sshReadyScript),
+		Interpreter: pulumi.ToStringArray([]string{"/bin/bash", "-c"}),
+		Environment: pulumi.StringMap{
+			"HOST":    address,
+			"PORT":    pulumi.String(strconv.Itoa(port)),
+			"TIMEOUT": pulumi.String(strconv.Itoa(int(timeout.Seconds()))),
+		},
+	}, options.resourceOpts(pulumi.DependsOn([]pulumi.Resource{prior}))...)
+	if err != nil {
+		return nil, err
+	}
+	outputLocalCmd(options.Steps, options.name("wait-for-ssh"), cmdResult, prior)
+	return cmdResult, nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/pulumi/pulumi-command/sdk/go/command/local"
+	"github.com/pulumi/pulumi-command/sdk/go/command/remote"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+// registryAuthSpec describes a registry with short-lived credentials.
+// TokenCommand runs locally and must print a fresh token on stdout, e.g.
+// `aws ecr get-login-password`. Without one, the registryToken secret is
+// used as is.
+type registryAuthSpec struct {
+	Server       string `json:"server"`
+	Username     string `json:"username"`
+	TokenCommand string `json:"tokenCommand"`
+	// Token is the registryToken secret, which HasToken says is set.
+	Token    pulumi.StringOutput `json:"-"`
+	HasToken bool                `json:"-"`
+}
+
+func (r registryAuthSpec) enabled() bool {
+	return r.TokenCommand != "" || r.HasToken
+}
+
+func (r registryAuthSpec) validate() error {
+	if !r.enabled() {
+		return nil
+	}
+	if r.Server == "" || r.Username == "" {
+		return fmt.Errorf("registryAuth needs a server and username alongside tokenCommand or the registryToken secret")
+	}
+	return nil
+}
+
+// refreshRegistryLogin fetches a new token, or takes the registryToken
+// secret, and logs the droplet's docker into the registry with it. Both steps
+// re-run on every deploy, since the token from the previous one has likely
+// expired. The token never leaves secret outputs and reaches docker over
+// stdin, not the command line.
+func refreshRegistryLogin(ctx *pulumi.Context, conn remote.ConnectionInput, options commandOptions, auth registryAuthSpec, prior pulumi.Resource) (*remote.Command, error) {
+	fmt.Println("Refreshing registry credentials for", auth.Server)
+	var runId = pulumi.String(strconv.FormatInt(time.Now().UnixNano(), 10))
+	var token, dependsOn = auth.Token, prior
+	if auth.TokenCommand != "" {
+		var fetch, err = local.NewCommand(ctx, options.name("fetch-registry-token"), &local.CommandArgs{
+			Create:   pulumi.String(auth.TokenCommand),
+			Triggers: pulumi.Array{runId},
+		}, options.resourceOpts(pulumi.AdditionalSecretOutputs([]string{"stdout"}), pulumi.DependsOn([]pulumi.Resource{prior}))...)
+		if err != nil {
+			return nil, err
+		}
+		token, dependsOn = pulumi.ToSecret(fetch.Stdout).(pulumi.StringOutput), fetch
+	}
+	return remote.NewCommand(ctx, options.name("registry-login"), &remote.CommandArgs{
+		Connection: conn,
+		Create:     pulumi.String(options.privileged(fmt.Sprintf("docker login --username '%s' --password-stdin '%s'", auth.Username, auth.Server))),
+		Stdin:      token,
+		Triggers:   pulumi.Array{runId},
+	}, options.resourceOpts(pulumi.DependsOn([]pulumi.Resource{dependsOn}))...)
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/pulumi/pulumi-digitalocean/sdk/v4/go/digitalocean"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+// createReservedIp reserves an address in region and assigns it to the
+// droplet. The address survives the droplet being replaced; only its
+// assignment moves to the new droplet. The pinned SDK predates DigitalOcean's
+// rename of floating IPs to reserved IPs, hence FloatingIp.
+func createReservedIp(ctx *pulumi.Context, region string, dropletId pulumi.IntOutput, opts ...pulumi.ResourceOption) (*digitalocean.FloatingIp, error) {
+	fmt.Println("Reserving an IP for the Droplet.")
+	var ip, err = digitalocean.NewFloatingIp(ctx, "rocket-reserved-ip", &digitalocean.FloatingIpArgs{
+		Region:    pulumi.String(region),
+		DropletId: dropletId,
+	}, opts...)
+	if err != nil {
+		return nil, err
+	}
+	ctx.Export("reserved-address", ip.IpAddress)
+	return ip, nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/pulumi/pulumi-command/sdk/go/command/local"
+	"github.com/pulumi/pulumi-digitalocean/sdk/v4/go/digitalocean"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+// The droplet ignores changes to its size, so this is the only thing that
+// reacts when the configured size moves. It is a no-op when the droplet
+// already has the requested size, which covers the initial create. Like the
+// DNS rollback, it runs locally and needs doctl on the PATH, authenticated
+// against the same account.
+const resizeScript = `set -e
+current=$(doctl compute droplet get "$DROPLET_ID" --format Size --no-header)
+if [ "$current" = "$DROPLET_SIZE" ]; then
+	echo "droplet $DROPLET_ID already at $DROPLET_SIZE"
+	exit 0
+fi
+doctl compute droplet-action power-off "$DROPLET_ID" --wait
+doctl compute droplet-action resize "$DROPLET_ID" --size "$DROPLET_SIZE" --wait
+doctl compute droplet-action power-on "$DROPLET_ID" --wait
+echo "droplet $DROPLET_ID resized from $current to $DROPLET_SIZE"
+`
+
+func resizeDroplet(ctx *pulumi.Context, name string, droplet *digitalocean.Droplet, size string, steps *provisioningSteps, opts ...pulumi.ResourceOption) (*local.Command, error) {
+	fmt.Println("Checking Droplet size.")
+	var deps = []pulumi.Resource{droplet}
+	opts = append(opts, pulumi.DependsOn(deps))
+	var cmdResult, err = local.NewCommand(ctx, name, &local.CommandArgs{
+		Create: pulumi.String(resizeScript),
+		Environment: pulumi.StringMap{
+			"DROPLET_ID":   droplet.ID().ToStringOutput(),
+			"DROPLET_SIZE": pulumi.String(size),
+		},
+		Triggers: pulumi.Array{pulumi.String(size)},
+	}, opts...)
+	if err != nil {
+		return nil, err
+	}
+	outputLocalCmd(steps, name, cmdResult, droplet)
+	return cmdResult, nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pulumi/pulumi-command/sdk/go/command/local"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+var scanSeverities = []string{"low", "medium", "high", "critical"}
+
+// scanCommand builds a scanner invocation that exits non-zero when it finds a
+// vulnerability at or above severity. The image is read from $IMAGE.
+func scanCommand(scanner, severity string) (string, error) {
+	var threshold = -1
+	for i, level := range scanSeverities {
+		if level == severity {
+			threshold = i
+		}
+	}
+	if threshold < 0 {
+		return "", fmt.Errorf("scanSeverity must be one of %v, got %q", scanSeverities, severity)
+	}
+	switch scanner {
+	case "trivy":
+		var levels = strings.ToUpper(strings.Join(scanSeverities[threshold:], ","))
+		return fmt.Sprintf("trivy image --no-progress --exit-code 1 --severity %s \"$IMAGE\"", levels), nil
+	case "grype":
+		return fmt.Sprintf("grype \"$IMAGE\" --fail-on %s", severity), nil
+	default:
+		return "", fmt.Errorf("scanner must be trivy or grype, got %q", scanner)
+	}
+}
+
+func scanImage(ctx *pulumi.Context, scanner string, image pulumi.StringInput, severity string, steps *provisioningSteps) (*local.Command, error) {
+	fmt.Println("Scanning image.")
+	var script, err = scanCommand(scanner, severity)
+	if err != nil {
+		return nil, err
+	}
+	cmdResult, err := local.NewCommand(ctx, "scan-image", &local.CommandArgs{
+		Create:      pulumi.String(script),
+		Environment: pulumi.StringMap{"IMAGE": image},
+		Triggers:    pulumi.Array{pulumi.String(script), image},
+	})
+	if err != nil {
+		return nil, err
+	}
+	outputLocalCmd(steps, "scan-image", cmdResult)
+	return cmdResult, nil
+}
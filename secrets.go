@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+// requiredSecrets lists the secret config keys the enabled features need.
+// privateKey is only needed when privateKeyPath can't be read, and the
+// passphrase only when the key is encrypted.
+func (c *appConfig) requiredSecrets(conf *stackConfig) []string {
+	var keys []string
+	var key = []byte(conf.Get("privateKey"))
+	if !c.HasInlineKey {
+		var raw, err = os.ReadFile(c.sshKeyPath())
+		if err != nil {
+			keys = append(keys, "privateKey")
+		}
+		key = raw
+	}
+	if privateKeyEncrypted(key) {
+		keys = append(keys, "privateKeyPassphrase")
+	}
+	if c.Alerts.Enabled && c.Alerts.SlackChannel != "" {
+		keys = append(keys, "alertsSlackUrl")
+	}
+	if c.BuildImage && c.RegistryAuth.TokenCommand == "" {
+		keys = append(keys, "registryToken")
+	}
+	if c.IntegrationTestPath != "" {
+		keys = append(keys, "integrationTestToken")
+	}
+	return keys
+}
+
+// sshKeyPath is the private key file the provisioning connection reads when
+// no inline privateKey secret is configured.
+func (c *appConfig) sshKeyPath() string {
+	if c.Provider == "ssh" && c.SSHTarget.PrivateKeyPath != "" {
+		return c.SSHTarget.PrivateKeyPath
+	}
+	return c.PrivateKeyPath
+}
+
+// sshLogin is the user and port provisioning connects as.
+func (c *appConfig) sshLogin() (string, int) {
+	if c.Provider == "ssh" {
+		return c.SSHTarget.User, c.SSHTarget.Port
+	}
+	return c.SSHUser, c.SSHPort
+}
+
+// sshCommand is the command that logs in to the host at address, with any
+// extra options. An inline privateKey has no file to point -i at, so it's
+// left to the ssh agent.
+func (c *appConfig) sshCommand(address pulumi.StringOutput, options ...string) pulumi.StringOutput {
+	var user, port = c.sshLogin()
+	var flags string
+	for _, option := range options {
+		flags += " " + option
+	}
+	if !c.HasInlineKey {
+		flags += " -i " + c.sshKeyPath()
+	}
+	if port != 0 && port != 22 {
+		flags += fmt.Sprintf(" -p %d", port)
+	}
+	return pulumi.Sprintf("ssh%s %s@%s", flags, user, address)
+}
+
+// sshPrivateKey prefers the inline privateKey secret over the key file. Either
+// way the key must parse, and is decrypted with privateKeyPassphrase if set.
+// The passphrase stays a secret output throughout, so the check happens once
+// it resolves.
+func (c *appConfig) sshPrivateKey() (pulumi.StringInput, error) {
+	var key, source = c.PrivateKey, "privateKey"
+	if !c.HasInlineKey {
+		var raw, err = os.ReadFile(c.sshKeyPath())
+		if err != nil {
+			return nil, err
+		}
+		key, source = pulumi.ToSecret(pulumi.String(raw)).(pulumi.StringOutput), c.sshKeyPath()
+	}
+	return pulumi.All(key, c.PrivateKeyPassphrase).ApplyT(func(args []interface{}) (string, error) {
+		var usable, err = usablePrivateKey([]byte(args[0].(string)), args[1].(string))
+		if err != nil {
+			return "", fmt.Errorf("%s: %w", source, err)
+		}
+		return usable, nil
+	}).(pulumi.StringOutput), nil
+}
+
+// sshPublicKey returns the public key to upload, reading sshPublicKeyPath when
+// the key isn't given inline. It is empty when neither is configured.
+func (c *appConfig) sshPublicKey() (string, error) {
+	if c.PublicKeyPath == "" {
+		return c.PublicKey, nil
+	}
+	var key, err = os.ReadFile(c.PublicKeyPath)
+	if err != nil {
+		return "", fmt.Errorf("reading sshPublicKeyPath: %w", err)
+	}
+	return strings.TrimSpace(string(key)), nil
+}
+
+// checkSecrets reports every missing secret at once, before any resource is
+// created, rather than failing on the first one partway through a deploy.
+// The values themselves are only ever read with GetSecret.
+func checkSecrets(conf *stackConfig, cfg *appConfig) error {
+	var missing []string
+	for _, key := range cfg.requiredSecrets(conf) {
+		// Get returns the decrypted value, so this also catches empty secrets.
+		switch {
+		case conf.Get(key) != "":
+		case key == "privateKey":
+			missing = append(missing, fmt.Sprintf("config %q, or a readable privateKeyPath instead of %s", key, cfg.sshKeyPath()))
+		default:
+			missing = append(missing, fmt.Sprintf("config %q", key))
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("missing secrets: %s", strings.Join(missing, "; "))
+	}
+	return nil
+}
+
+// checkLocalFiles reports every local file the deploy reads that is missing
+// or unreadable, before any resource is created. Otherwise a missing
+// template only surfaces once the droplet exists and the copy fails.
+func checkLocalFiles(cfg *appConfig) error {
+	var files = map[string]string{"unit template": unitTemplatePath}
+	if cfg.Runtime == "compose" {
+		files = map[string]string{"compose template": composeTemplatePath}
+	}
+	if cfg.PublicKeyPath != "" {
+		files["sshPublicKeyPath"] = cfg.PublicKeyPath
+	}
+	if cfg.IntegrationTestPath != "" {
+		files["integrationTestPath"] = cfg.IntegrationTestPath
+	}
+	if cfg.BuildImage {
+		files["buildContext"] = cfg.BuildContext
+	}
+	var names = make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var missing []string
+	for _, name := range names {
+		var f, err = os.Open(files[name])
+		if err != nil {
+			missing = append(missing, fmt.Sprintf("%s %s (%v)", name, files[name], err))
+			continue
+		}
+		f.Close()
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("missing local files: %s", strings.Join(missing, "; "))
+	}
+	return nil
+}
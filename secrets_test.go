@@ -0,0 +1,36 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"strings"
+	"testing"
+)
+
+func TestCheckSecretsReportsEveryMissingSecret(t *testing.T) {
+	var block, _ = pem.Decode([]byte(testPrivateKey(t)))
+	// A legacy encrypted PEM block is the simplest passphrase-protected key.
+	var encrypted, err = x509.EncryptPEMBlock(strings.NewReader(strings.Repeat("x", 64)), block.Type, block.Bytes, []byte("hunter2"), x509.PEMCipherAES256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m = &mocks{}
+	err = runDeploy(t, m, map[string]string{
+		"privateKey":          string(pem.EncodeToMemory(encrypted)),
+		"alerts":              `{"enabled": true, "slackChannel": "#ops"}`,
+		"buildImage":          "true",
+		"registryAuth":        `{"server": "registry.digitalocean.com", "username": "deploy"}`,
+		"integrationTestPath": "main_test.go",
+	})
+	if err == nil {
+		t.Fatal("want an error for the missing secrets, got none")
+	}
+	for _, key := range []string{"privateKeyPassphrase", "alertsSlackUrl", "registryToken", "integrationTestToken"} {
+		if !strings.Contains(err.Error(), `"`+key+`"`) {
+			t.Errorf("error %q doesn't mention %s", err, key)
+		}
+	}
+	if len(m.resources) != 0 {
+		t.Errorf("registered %d resources before failing", len(m.resources))
+	}
+}
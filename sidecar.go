@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/pulumi/pulumi-command/sdk/go/command/remote"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+// SidecarParams describes an extra container run next to the app under its
+// own systemd unit.
+type SidecarParams struct {
+	Name  string `json:"name"`
+	Image string `json:"image"`
+	// RunArgs are extra `docker run` flags, such as ports and volumes.
+	RunArgs []string `json:"runArgs"`
+}
+
+var sidecarNamePattern = regexp.MustCompile(`^[a-z][a-z0-9-]*$`)
+
+// cadvisorSidecar is the default monitoring agent: per-container metrics on
+// port 8080, read from the host's docker and cgroup state. The port is only
+// bound on loopback, since docker's published ports bypass the firewall;
+// reach it through an SSH tunnel.
+var cadvisorSidecar = SidecarParams{
+	Name:  "cadvisor",
+	Image: "gcr.io/cadvisor/cadvisor:v0.47.0",
+	RunArgs: []string{
+		"-p 127.0.0.1:8080:8080",
+		"--privileged",
+		"-v /:/rootfs:ro",
+		"-v /var/run:/var/run:ro",
+		"-v /sys:/sys:ro",
+		"-v /var/lib/docker/:/var/lib/docker:ro",
+	},
+}
+
+func (s SidecarParams) validate() error {
+	if !sidecarNamePattern.MatchString(s.Name) {
+		return fmt.Errorf("sidecar name %q must be lowercase letters, digits and dashes", s.Name)
+	}
+	if s.Image == "" {
+		return fmt.Errorf("sidecar %s needs an image", s.Name)
+	}
+	return nil
+}
+
+func renderSidecarUnit(s SidecarParams) string {
+	var runArgs = strings.Join(append([]string{"--name", s.Name}, s.RunArgs...), " ")
+	return fmt.Sprintf(`[Unit]
+Description = "%[1]s sidecar"
+After=docker.service
+Requires=docker.service
+
+[Service]
+ExecStartPre=-/usr/bin/docker rm -f %[1]s
+ExecStart=/usr/bin/docker run %[2]s %[3]s
+ExecStop=/usr/bin/docker stop %[1]s
+Restart=always
+
+[Install]
+WantedBy=multi-user.target
+`, s.Name, runArgs, s.Image)
+}
+
+func provisionSidecars(ctx *pulumi.Context, conn remote.ConnectionInput, options commandOptions, sidecars []SidecarParams, prior pulumi.Resource) (pulumi.Resource, error) {
+	var last = prior
+	for _, sidecar := range sidecars {
+		fmt.Println("Provisioning sidecar", sidecar.Name)
+		var unitName = sidecar.Name + ".service"
+		var unit, err = copyRenderedFile(ctx, unitName, renderSidecarUnit(sidecar), "/etc/systemd/system/"+unitName, conn, options, last)
+		if err != nil {
+			return nil, err
+		}
+		last, err = chainCommand(ctx, "start-"+sidecar.Name, "systemctl daemon-reload && systemctl enable --now "+unitName, conn, options, unit)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return last, nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/pulumi/pulumi-digitalocean/sdk/v4/go/digitalocean"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+const defaultDropletImage = "docker-20-04"
+
+func goldenSnapshotName(stack string) string {
+	return "rocket-golden-" + stack
+}
+
+// dropletImage returns the golden snapshot from an earlier deploy when there
+// is one, so new droplets start with docker and the image already in place.
+// Otherwise it returns base. Any lookup failure other than not-found is an
+// error, so a flaky API doesn't quietly rebuild every droplet from base.
+func dropletImage(ctx *pulumi.Context, base string, useSnapshot bool) (string, error) {
+	if !useSnapshot {
+		return base, nil
+	}
+	var name = goldenSnapshotName(ctx.Stack())
+	var snapshot, err = digitalocean.LookupDropletSnapshot(ctx, &digitalocean.LookupDropletSnapshotArgs{
+		Name:       &name,
+		MostRecent: pulumi.BoolRef(true),
+	})
+	if err != nil {
+		if isNotFound(err) {
+			ctx.Log.Info(fmt.Sprintf("no golden snapshot %q yet, using %s", name, base), nil)
+			return base, nil
+		}
+		return "", fmt.Errorf("looking up golden snapshot %q: %w", name, err)
+	}
+	return snapshot.Id, nil
+}
+
+// createGoldenSnapshot snapshots the droplet once its service is healthy.
+// It is only retaken when the droplet is replaced.
+func createGoldenSnapshot(ctx *pulumi.Context, droplet *digitalocean.Droplet, healthy pulumi.Resource, opts ...pulumi.ResourceOption) (*digitalocean.DropletSnapshot, error) {
+	fmt.Println("Snapshotting the Droplet.")
+	var snapshot, err = digitalocean.NewDropletSnapshot(ctx, "golden-snapshot", &digitalocean.DropletSnapshotArgs{
+		DropletId: droplet.ID().ToStringOutput(),
+		Name:      pulumi.String(goldenSnapshotName(ctx.Stack())),
+	}, append(opts, pulumi.DependsOn([]pulumi.Resource{healthy}))...)
+	if err != nil {
+		return nil, err
+	}
+	ctx.Export("golden-snapshot-id", snapshot.ID())
+	return snapshot, nil
+}
+
+func snapshotName(stack, label string) string {
+	return fmt.Sprintf("rocket-%s-%s", stack, label)
+}
+
+// createDropletSnapshot captures the droplet once ready, normally its final
+// health check, has completed. A new label takes a new snapshot; the ones taken before are
+// kept rather than deleted, so they stay available to restore from.
+func createDropletSnapshot(ctx *pulumi.Context, droplet *digitalocean.Droplet, label string, ready pulumi.Resource, opts ...pulumi.ResourceOption) (*digitalocean.DropletSnapshot, error) {
+	fmt.Println("Taking a snapshot of the Droplet.")
+	var snapshot, err = digitalocean.NewDropletSnapshot(ctx, "rocket-snapshot", &digitalocean.DropletSnapshotArgs{
+		DropletId: droplet.ID().ToStringOutput(),
+		Name:      pulumi.String(snapshotName(ctx.Stack(), label)),
+	}, append(opts, pulumi.DependsOn([]pulumi.Resource{ready}), pulumi.RetainOnDelete(true))...)
+	if err != nil {
+		return nil, err
+	}
+	ctx.Export("snapshot-id", snapshot.ID())
+	return snapshot, nil
+}
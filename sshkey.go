@@ -0,0 +1,74 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// privateKeyEncrypted reports whether key needs a passphrase to parse.
+func privateKeyEncrypted(key []byte) bool {
+	var _, err = ssh.ParseRawPrivateKey(key)
+	var missing *ssh.PassphraseMissingError
+	return errors.As(err, &missing)
+}
+
+// usablePrivateKey checks that the provisioning connection can use the PEM
+// key, decrypting it with passphrase when one is given. The connection has no
+// passphrase of its own, so an encrypted key is handed over decrypted; an
+// unencrypted one is handed over unchanged.
+func usablePrivateKey(key []byte, passphrase string) (string, error) {
+	if passphrase == "" {
+		var parsed, err = ssh.ParseRawPrivateKey(key)
+		var missing *ssh.PassphraseMissingError
+		if errors.As(err, &missing) {
+			return "", fmt.Errorf("the SSH private key is encrypted; set the privateKeyPassphrase secret")
+		}
+		if err != nil {
+			return "", fmt.Errorf("parsing the SSH private key: %w", err)
+		}
+		if _, err := encodePrivateKey(parsed); err != nil {
+			return "", err
+		}
+		return string(key), nil
+	}
+	var parsed, err = ssh.ParseRawPrivateKeyWithPassphrase(key, []byte(passphrase))
+	if err != nil {
+		return "", fmt.Errorf("decrypting the SSH private key with privateKeyPassphrase: %w", err)
+	}
+	return encodePrivateKey(parsed)
+}
+
+// encodePrivateKey PEM-encodes an RSA, ECDSA or ed25519 key in a format the
+// connection can parse, and rejects any other kind.
+func encodePrivateKey(key interface{}) (string, error) {
+	var block *pem.Block
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		block = &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}
+	case *ecdsa.PrivateKey:
+		var der, err = x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return "", err
+		}
+		block = &pem.Block{Type: "EC PRIVATE KEY", Bytes: der}
+	case ed25519.PrivateKey, *ed25519.PrivateKey:
+		if ptr, ok := key.(*ed25519.PrivateKey); ok {
+			key = *ptr
+		}
+		var der, err = x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return "", err
+		}
+		block = &pem.Block{Type: "PRIVATE KEY", Bytes: der}
+	default:
+		return "", fmt.Errorf("SSH private keys of type %T are not supported; use ed25519, ECDSA or RSA", key)
+	}
+	return string(pem.EncodeToMemory(block)), nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"time"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+// provisioningStep is the pending result of one provisioning command.
+type provisioningStep struct {
+	name    string
+	started pulumi.IntOutput
+	stdout  pulumi.StringOutput
+	stderr  pulumi.StringOutput
+}
+
+// provisioningSteps collects one deploy's recorded commands in the order they
+// were declared, for exportProvisioningResults. The deploy owns it and hands
+// it down to whatever creates commands, so a second deploy in the same
+// process starts from an empty list.
+type provisioningSteps []provisioningStep
+
+// record adds a command to the provisioningResults output. Its duration runs
+// from the last of prior completing (or from now, without any) until the
+// command's outputs resolve, so it is only as precise as the engine's
+// scheduling. A nil list records nothing.
+func (s *provisioningSteps) record(name string, stdout, stderr pulumi.StringOutput, prior ...pulumi.Resource) {
+	if s == nil {
+		return
+	}
+	var started = pulumi.Int(int(time.Now().UnixMilli())).ToIntOutput()
+	var ids []interface{}
+	for _, res := range prior {
+		if res, ok := res.(pulumi.CustomResource); ok {
+			ids = append(ids, res.ID())
+		}
+	}
+	if len(ids) > 0 {
+		started = pulumi.All(ids...).ApplyT(func([]interface{}) int {
+			return int(time.Now().UnixMilli())
+		}).(pulumi.IntOutput)
+	}
+	*s = append(*s, provisioningStep{
+		name:    name,
+		started: started,
+		stdout:  stdout,
+		stderr:  stderr,
+	})
+}
+
+// exportProvisioningResults exports provisioningResults, an array of
+// {step, succeeded, stdout, stderr, durationMs} that CI can parse in one go.
+// A failing command fails the update before anything is exported, so every
+// step that is listed succeeded. Commands whose output is secret, such as
+// the registry token fetch, are never recorded. It returns the exported
+// results for reuse in other outputs.
+func exportProvisioningResults(ctx *pulumi.Context, steps provisioningSteps) pulumi.ArrayOutput {
+	var results = make([]interface{}, len(steps))
+	for i, step := range steps {
+		var name = step.name
+		results[i] = pulumi.All(step.started, step.stdout, step.stderr).ApplyT(func(args []interface{}) map[string]interface{} {
+			return map[string]interface{}{
+				"step":       name,
+				"succeeded":  true,
+				"stdout":     args[1].(string),
+				"stderr":     args[2].(string),
+				"durationMs": int(time.Now().UnixMilli()) - args[0].(int),
+			}
+		})
+	}
+	var all = pulumi.All(results...)
+	ctx.Export("provisioningResults", all)
+	return all
+}
+
+// exportCommands exports commands, each recorded step's stdout and stderr
+// keyed by its resource name, so two deploys' outputs can be diffed step by
+// step. It draws on the same steps as provisioningResults.
+func exportCommands(ctx *pulumi.Context, steps provisioningSteps) {
+	var commands = pulumi.Map{}
+	for _, step := range steps {
+		commands[step.name] = pulumi.Map{
+			"stdout": step.stdout,
+			"stderr": step.stderr,
+		}
+	}
+	ctx.Export("commands", commands)
+}
+
+// exportDeployment exports deployment, the app's key outputs in one object,
+// so CI can read everything from a single `pulumi stack output --json` key.
+// The individual outputs are still exported alongside it.
+func exportDeployment(ctx *pulumi.Context, app *WebApp, commands pulumi.ArrayOutput) {
+	var exposureOutputs = pulumi.Map{}
+	for name, value := range app.exposure.Outputs {
+		exposureOutputs[name] = value
+	}
+	var droplet = pulumi.Map{
+		"ip":  app.DropletIP,
+		"ips": app.DropletIPs,
+	}
+	for key, value := range app.metadata {
+		droplet[key] = value
+	}
+	ctx.Export("deployment", pulumi.Map{
+		"droplet": droplet,
+		"loadBalancer": pulumi.Map{
+			"ip": app.LoadBalancerIP,
+		},
+		"dns": pulumi.Map{
+			"url": app.URL,
+		},
+		"exposure": exposureOutputs,
+		"commands": commands,
+	})
+}
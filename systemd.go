@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+const unitTemplatePath = "rocket.service"
+
+// SystemdParams are the values substituted into the rocket.service template.
+type SystemdParams struct {
+	// Name names the unit, <Name>.service, and the container it runs.
+	Name string
+	// Image is the container image the unit runs, without a tag.
+	Image string
+	// ImageTag is appended to Image when set.
+	ImageTag string
+	// ImageDigest pins Image to an exact build, e.g. sha256:…, and takes
+	// precedence over ImageTag.
+	ImageDigest string
+	// DrainTimeout is how many seconds the container gets after SIGTERM to
+	// finish in-flight requests before docker kills it. DigitalOcean load
+	// balancers have no deregistration delay to match, so only the unit uses it.
+	DrainTimeout int
+	// User runs the container as the given user (name or uid, optionally with
+	// a :group) rather than root, so a compromised app can't act as root on
+	// the host's docker-mapped files. Empty keeps docker's default of root.
+	User string
+	// ReadOnly mounts the container's root filesystem read-only, which stops
+	// an attacker from persisting changes inside the container.
+	ReadOnly bool
+	// ContainerPort is the port the app listens on inside the container;
+	// docker publishes it on the host's port 80.
+	ContainerPort int
+	// Environment is set in the unit and passed through to the container.
+	Environment map[string]string
+	// InitFilePath overrides where the unit is installed. Its file name must
+	// still be UnitFile() so systemctl can find it.
+	InitFilePath string
+	// WantedBy is the boot target `systemctl enable` hooks the unit into.
+	WantedBy string
+	// Sidecars run alongside the app, each under its own unit.
+	Sidecars []SidecarParams
+}
+
+var containerUserPattern = regexp.MustCompile(`^([a-z_][a-z0-9_-]*|[0-9]+)(:([a-z_][a-z0-9_-]*|[0-9]+))?$`)
+
+var systemdTargetPattern = regexp.MustCompile(`^[A-Za-z0-9@._-]+\.target$`)
+
+var imageTagPattern = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]{0,127}$`)
+
+var imageDigestPattern = regexp.MustCompile(`^sha256:[a-f0-9]{64}$`)
+
+var systemdUnitNamePattern = regexp.MustCompile(`^[A-Za-z0-9@._-]+\.(service|socket|timer)$`)
+
+var serviceNamePattern = regexp.MustCompile(`^[a-z][a-z0-9_-]*$`)
+
+func (p SystemdParams) validate() error {
+	if !serviceNamePattern.MatchString(p.Name) {
+		return fmt.Errorf("service name %q may only contain lowercase letters, digits, dashes and underscores", p.Name)
+	}
+	if p.Image == "" || strings.ContainsAny(p.Image, " '\"") {
+		return fmt.Errorf("image %q is not a valid image reference", p.Image)
+	}
+	if p.ImageTag != "" && !imageTagPattern.MatchString(p.ImageTag) {
+		return fmt.Errorf("imageTag %q is not a valid docker tag", p.ImageTag)
+	}
+	if p.ImageDigest != "" && !imageDigestPattern.MatchString(p.ImageDigest) {
+		return fmt.Errorf("image digest %q is not a sha256 digest", p.ImageDigest)
+	}
+	if !systemdTargetPattern.MatchString(p.WantedBy) {
+		return fmt.Errorf("wantedBy must name a systemd target such as multi-user.target, got %q", p.WantedBy)
+	}
+	for _, sidecar := range p.Sidecars {
+		if err := sidecar.validate(); err != nil {
+			return err
+		}
+	}
+	if p.ContainerPort < 1 || p.ContainerPort > 65535 {
+		return fmt.Errorf("containerPort must be between 1 and 65535, got %d", p.ContainerPort)
+	}
+	for key, value := range p.Environment {
+		if !envVarPattern.MatchString(key) {
+			return fmt.Errorf("environment: %q is not a valid variable name", key)
+		}
+		if strings.ContainsAny(value, "\"\n\\") {
+			return fmt.Errorf("environment: the value of %s must not contain quotes, backslashes or newlines", key)
+		}
+	}
+	if p.InitFilePath != "" && (!path.IsAbs(p.InitFilePath) || path.Base(p.InitFilePath) != p.UnitFile()) {
+		return fmt.Errorf("initFilePath must be an absolute path ending in %s, got %q", p.UnitFile(), p.InitFilePath)
+	}
+	if p.DrainTimeout < 0 {
+		return fmt.Errorf("drainTimeout must not be negative, got %d", p.DrainTimeout)
+	}
+	if p.User != "" && !containerUserPattern.MatchString(p.User) {
+		return fmt.Errorf("containerUser %q must be a user name or uid, optionally followed by :group", p.User)
+	}
+	return nil
+}
+
+// UnitFile is the unit's file name, e.g. rocket.service.
+func (p SystemdParams) UnitFile() string {
+	return p.Name + ".service"
+}
+
+// UnitPath is where the unit is installed on the host.
+func (p SystemdParams) UnitPath() string {
+	if p.InitFilePath != "" {
+		return p.InitFilePath
+	}
+	return "/etc/systemd/system/" + p.UnitFile()
+}
+
+// EnvKeys lists Environment's keys in a stable order, so the rendered unit
+// only changes when its values do.
+func (p SystemdParams) EnvKeys() []string {
+	var keys = make([]string, 0, len(p.Environment))
+	for key := range p.Environment {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// EnvValue escapes % so systemd doesn't read it as a specifier.
+func (p SystemdParams) EnvValue(key string) string {
+	return strings.ReplaceAll(p.Environment[key], "%", "%%")
+}
+
+func (p SystemdParams) ImageRef() string {
+	if p.ImageDigest != "" {
+		return p.Image + "@" + p.ImageDigest
+	}
+	if p.ImageTag == "" {
+		return p.Image
+	}
+	return p.Image + ":" + p.ImageTag
+}
+
+// StopTimeout gives systemd a little more patience than docker, so that the
+// drain window is never cut short by systemd's own SIGKILL.
+func (p SystemdParams) StopTimeout() int {
+	return p.DrainTimeout + 5
+}
+
+func renderSystemdUnit(params SystemdParams) (string, error) {
+	var raw, err = os.ReadFile(unitTemplatePath)
+	if err != nil {
+		return "", err
+	}
+	tmpl, err := template.New(unitTemplatePath).Parse(string(raw))
+	if err != nil {
+		return "", err
+	}
+	var out bytes.Buffer
+	if err := tmpl.Execute(&out, params); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
+
+var secretEnvPattern = regexp.MustCompile(`(?i)(secret|token|passw|key|credential|_url)`)
+
+// redactUnit masks the value of any Environment= entry whose name looks like
+// it carries a secret, so the unit can be shown in stack outputs.
+func redactUnit(unit string) string {
+	var lines = strings.Split(unit, "\n")
+	for i, line := range lines {
+		if !strings.HasPrefix(line, "Environment=") {
+			continue
+		}
+		var assignment = strings.Trim(strings.TrimPrefix(line, "Environment="), `"`)
+		var name = strings.SplitN(assignment, "=", 2)[0]
+		if secretEnvPattern.MatchString(name) {
+			lines[i] = fmt.Sprintf("Environment=%s=[redacted]", name)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/pulumi/pulumi-digitalocean/sdk/v4/go/digitalocean"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+const tagLookupAttempts = 3
+
+var invalidTagChars = regexp.MustCompile(`[^A-Za-z0-9:_-]`)
+
+// stackTag marks everything the stack creates that can carry a tag, so its
+// resources, and their cost, can be told apart from other stacks'.
+func stackTag(stack string) string {
+	return "rocket:" + invalidTagChars.ReplaceAllString(stack, "-")
+}
+
+// ensureTags declares every tag on every deploy, so a tag stays in the
+// stack's state once it's there. A tag that already exists is adopted with an
+// import, which the engine skips once it manages the tag under the same ID; a
+// missing one is created. Either way it is retained on delete, since other
+// stacks may use it too. DigitalOcean answers a create for an existing tag
+// with that tag, so another stack creating it between our lookup and our
+// create doesn't conflict, and the next deploy's lookup adopts it as usual.
+func ensureTags(ctx *pulumi.Context, deadline context.Context, names []string, opts ...pulumi.ResourceOption) (pulumi.StringArray, error) {
+	var tags = pulumi.StringArray{}
+	// A configured tag may repeat the stack's own, and declaring it twice
+	// would conflict on the resource name.
+	var declared = map[string]bool{}
+	for _, name := range names {
+		if declared[name] {
+			continue
+		}
+		declared[name] = true
+		var exists, err = tagExists(ctx, deadline, name)
+		if err != nil {
+			return nil, err
+		}
+		var tagOpts = append(append([]pulumi.ResourceOption{}, opts...), pulumi.RetainOnDelete(true))
+		if exists {
+			fmt.Println("Adopting tag", name)
+			tagOpts = append(tagOpts, pulumi.Import(pulumi.ID(name)))
+		} else {
+			fmt.Println("Creating tag", name)
+		}
+		tag, err := digitalocean.NewTag(ctx, "tag-"+name, &digitalocean.TagArgs{
+			Name: pulumi.String(name),
+		}, tagOpts...)
+		if err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag.Name)
+	}
+	return tags, nil
+}
+
+// isNotFound reports whether a data source lookup failed because nothing
+// matched. The provider only says so in the message: "... not found" for
+// named lookups, "query returned no results" for filtered ones.
+func isNotFound(err error) bool {
+	var msg = strings.ToLower(err.Error())
+	return strings.Contains(msg, "not found") || strings.Contains(msg, "returned no results")
+}
+
+// tagExists retries transient lookup failures with backoff, but treats a
+// not-found answer as final.
+func tagExists(ctx *pulumi.Context, deadline context.Context, name string) (bool, error) {
+	var err error
+	for attempt := 0; attempt < tagLookupAttempts; attempt++ {
+		if attempt > 0 {
+			if err := sleepCtx(deadline, time.Duration(1<<attempt)*time.Second); err != nil {
+				return false, err
+			}
+		}
+		_, err = digitalocean.LookupTag(ctx, &digitalocean.LookupTagArgs{Name: name})
+		if err == nil {
+			return true, nil
+		}
+		if isNotFound(err) {
+			return false, nil
+		}
+	}
+	return false, fmt.Errorf("looking up tag %q: %w", name, err)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+const tagType = "digitalocean:index/tag:Tag"
+
+func TestEnsureTagsAdoptsExistingTags(t *testing.T) {
+	var m = &mocks{}
+	if err := runDeploy(t, m, map[string]string{"tags": `["team:web", "rocket:dev"]`}); err != nil {
+		t.Fatal(err)
+	}
+	var ids = map[string]string{}
+	for _, res := range m.resources {
+		if res.TypeToken != tagType {
+			continue
+		}
+		if _, ok := ids[res.Name]; ok {
+			t.Errorf("%s declared more than once", res.Name)
+		}
+		ids[res.Name] = res.ID
+		if !res.RegisterRPC.GetRetainOnDelete() {
+			t.Errorf("%s is not retained on delete", res.Name)
+		}
+	}
+	var want = map[string]string{"tag-rocket:dev": "rocket:dev", "tag-team:web": "team:web"}
+	if len(ids) != len(want) {
+		t.Fatalf("declared tags %v, want %v", ids, want)
+	}
+	for name, id := range want {
+		if ids[name] != id {
+			t.Errorf("%s imports %q, want %q", name, ids[name], id)
+		}
+	}
+}
+
+func TestEnsureTagsCreatesMissingTags(t *testing.T) {
+	var m = &mocks{failing: map[string]error{
+		"digitalocean:index/getTag:getTag": errors.New("tag not found"),
+	}}
+	if err := runDeploy(t, m, nil); err != nil {
+		t.Fatal(err)
+	}
+	var res = m.registered(t, tagType)
+	if res.ID != "" {
+		t.Errorf("%s imports %q, want it created", res.Name, res.ID)
+	}
+	if !res.RegisterRPC.GetRetainOnDelete() {
+		t.Errorf("%s is not retained on delete", res.Name)
+	}
+}
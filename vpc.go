@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/pulumi/pulumi-digitalocean/sdk/v4/go/digitalocean"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+// vpcSpec puts the droplets, and the database if any, on a private network
+// of their own, so they talk to each other without leaving it.
+type vpcSpec struct {
+	Name string `json:"name"`
+	// IpRange is the network's private CIDR. Empty lets DigitalOcean pick one.
+	IpRange string `json:"ipRange"`
+}
+
+func (v vpcSpec) enabled() bool {
+	return v.Name != ""
+}
+
+func (v vpcSpec) validate() error {
+	if v.IpRange == "" {
+		return nil
+	}
+	var ip, network, err = net.ParseCIDR(v.IpRange)
+	if err != nil || !ip.IsPrivate() || ip.To4() == nil {
+		return fmt.Errorf("vpc.ipRange %q is not a private IPv4 CIDR", v.IpRange)
+	}
+	if size, _ := network.Mask.Size(); size < 16 || size > 28 {
+		return fmt.Errorf("vpc.ipRange must be between a /16 and a /28, got /%d", size)
+	}
+	return nil
+}
+
+// createVpc creates the network in region. Moving an existing droplet into it
+// replaces the droplet.
+func createVpc(ctx *pulumi.Context, spec vpcSpec, region string, opts ...pulumi.ResourceOption) (*digitalocean.Vpc, error) {
+	fmt.Println("Creating VPC.")
+	var args = &digitalocean.VpcArgs{
+		Name:   pulumi.String(spec.Name),
+		Region: pulumi.String(region),
+	}
+	if spec.IpRange != "" {
+		args.IpRange = pulumi.StringPtr(spec.IpRange)
+	}
+	var vpc, err = digitalocean.NewVpc(ctx, "rocket-vpc", args, opts...)
+	if err != nil {
+		return nil, err
+	}
+	ctx.Export("vpc-id", vpc.ID())
+	return vpc, nil
+}
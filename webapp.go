@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/pulumi/pulumi-command/sdk/go/command/remote"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+// WebApp is one deployed copy of the app: its hosts, the systemd-managed
+// container on each, and the LB and DNS in front of them. Everything it
+// creates is nested under it.
+type WebApp struct {
+	pulumi.ResourceState
+
+	// DropletIP is the first host's address; DropletIPs lists every host's.
+	DropletIP  pulumi.StringOutput
+	DropletIPs pulumi.StringArrayOutput
+	// LoadBalancerIP is empty when Caddy terminates TLS on the droplet and no
+	// LB is created.
+	LoadBalancerIP pulumi.StringOutput
+	URL            pulumi.StringOutput
+
+	exposure       *Exposure
+	changeTriggers pulumi.Array
+	// metadata describes the first host, as Host.Metadata does.
+	metadata pulumi.Map
+	// lastSteps holds each host's final provisioning step.
+	lastSteps []pulumi.Resource
+}
+
+// WebAppArgs sets the WebApp's placement and the service it runs.
+type WebAppArgs struct {
+	// Domain is the DigitalOcean domain the A record is created in.
+	Domain      string
+	Region      string
+	Size        string
+	Image       string
+	ServiceName string
+	// SSHSourceAddresses restricts inbound SSH to these CIDRs.
+	SSHSourceAddresses []string
+	// BootTimeout bounds how long provisioning waits for the host's sshd.
+	BootTimeout time.Duration
+	ImageTag    pulumi.StringOutput
+	// ImageDigest, when not empty, pins the image to an exact build.
+	ImageDigest pulumi.StringOutput
+
+	// config carries the rest of the deploy settings.
+	config   *appConfig
+	deadline context.Context
+	// hostDeps must complete before the host is created.
+	hostDeps []pulumi.Resource
+	// steps records the app's commands for the provisioningResults output.
+	steps *provisioningSteps
+}
+
+func NewWebApp(ctx *pulumi.Context, name string, args *WebAppArgs, opts ...pulumi.ResourceOption) (*WebApp, error) {
+	var app = &WebApp{}
+	if err := ctx.RegisterComponentResource("rocket:index:WebApp", name, app, opts...); err != nil {
+		return nil, err
+	}
+	var cfg = *args.config
+	cfg.Domain = args.Domain
+	cfg.Region = args.Region
+	cfg.Size = args.Size
+	cfg.Systemd.Image = args.Image
+	cfg.Systemd.Name = args.ServiceName
+	cfg.SSHSourceAddresses = args.SSHSourceAddresses
+	cfg.BootTimeout = args.BootTimeout
+	// The alias keeps resources created before the component existed from
+	// being replaced now that they are nested under it.
+	var childOpts = []pulumi.ResourceOption{
+		pulumi.Parent(app),
+		pulumi.Aliases([]pulumi.Alias{{NoParent: pulumi.Bool(true)}}),
+	}
+	var options = commandOptions{
+		RetryCount: cfg.CommandRetryCount,
+		RetryDelay: cfg.CommandRetryDelay,
+		Timeout:    cfg.CommandTimeout,
+		Resource:   childOpts,
+		Sudo:       cfg.UseSudo,
+		Steps:      args.steps,
+	}
+	// The deploy deadline can't stop the engine's commands, so each attempt
+	// is bounded by deployTimeoutMinutes instead.
+	options.DeployTimeout = cfg.DeployTimeout
+	// • Give the droplets, and the database, a private network of their own.
+	var vpcId pulumi.StringPtrInput
+	var err error
+	if cfg.VPC.enabled() {
+		vpc, err := createVpc(ctx, cfg.VPC, cfg.Region, childOpts...)
+		if err != nil {
+			return nil, err
+		}
+		vpcId = vpc.ID().ToStringOutput()
+	}
+	// • Pass the secret environment through as secrets.
+	var env = pulumi.StringMap{}
+	for key, value := range cfg.SecretEnvironment {
+		env[key] = pulumi.ToSecret(pulumi.String(value)).(pulumi.StringOutput)
+	}
+	// • Create the app's database, and hand the service its URI.
+	var database *appDatabase
+	if cfg.Database.Enabled {
+		var opts = childOpts
+		if cfg.protected(ctx.Stack()) {
+			opts = append(append([]pulumi.ResourceOption{}, childOpts...), pulumi.Protect(true))
+		}
+		database, err = createDatabase(ctx, cfg.Database, cfg.Region, vpcId, opts...)
+		if err != nil {
+			return nil, err
+		}
+		env[cfg.Database.EnvVar] = database.URI
+	}
+	// unit is what the host runs the app from: a systemd unit, or with the
+	// compose runtime, a compose file.
+	var unit pulumi.StringOutput
+	if cfg.Runtime == "compose" {
+		unit = composeFile(cfg.Systemd, cfg.ComposeServices, args.ImageTag, args.ImageDigest, env)
+		ctx.Export("compose-file", unit.ApplyT(redactComposeFile))
+	} else {
+		unit = systemdUnit(cfg.Systemd, args.ImageTag, args.ImageDigest, env)
+		ctx.Export("systemd-unit", unit.ApplyT(redactUnit))
+	}
+	// • With cloud-init, the droplet installs and starts the unit itself.
+	var userData pulumi.StringInput
+	if cfg.Provisioner == "cloud-init" {
+		userData = unit.ApplyT(func(unit string) string {
+			return renderCloudInit(cfg.Systemd.UnitPath(), cfg.Systemd.UnitFile(), unit)
+		}).(pulumi.StringOutput)
+	}
+	provider, err := newProvider(&cfg, args.deadline, userData, vpcId, args.steps, childOpts...)
+	if err != nil {
+		return nil, err
+	}
+
+	// • Create (or describe) the machines to provision.
+	hosts, err := provider.CreateHosts(ctx, args.hostDeps)
+	if err != nil {
+		return nil, err
+	}
+	// • Only let the app's own droplets reach the database.
+	if database != nil {
+		var ids []pulumi.StringOutput
+		for _, host := range hosts {
+			ids = append(ids, host.ID)
+		}
+		if _, err := trustDroplets(ctx, database.Cluster, ids, childOpts...); err != nil {
+			return nil, err
+		}
+	}
+	var healthy []*remote.Command
+	var addresses pulumi.StringArray
+	for i, host := range hosts {
+		var options = options
+		options.Suffix = cfg.hostSuffix(i)
+		var hostHealthy *remote.Command
+		var lastStep = host.Ready
+		if cfg.Provisioner == "cloud-init" {
+			app.changeTriggers = append(app.changeTriggers, host.ChangeTriggers...)
+		} else {
+			hostHealthy, lastStep, err = app.provisionHost(ctx, host, options, &cfg, unit)
+			if err != nil {
+				return nil, err
+			}
+		}
+		healthy = append(healthy, hostHealthy)
+		addresses = append(addresses, host.Address)
+		app.lastSteps = append(app.lastSteps, lastStep)
+	}
+
+	// • Route traffic to the healthy service.
+	app.exposure, err = provider.Expose(ctx, hosts, healthy)
+	if err != nil {
+		return nil, err
+	}
+	app.changeTriggers = append(app.changeTriggers, app.exposure.ChangeTriggers...)
+	app.DropletIP = hosts[0].Address
+	app.DropletIPs = addresses.ToStringArrayOutput()
+	app.metadata = hosts[0].Metadata
+	app.URL = pulumi.String(app.exposure.URL).ToStringOutput()
+	app.LoadBalancerIP = pulumi.String("").ToStringOutput()
+	if lbIp, ok := app.exposure.Outputs["lbIp"]; ok {
+		app.LoadBalancerIP = lbIp.ToStringOutput()
+	}
+	err = ctx.RegisterResourceOutputs(app, pulumi.Map{
+		"dropletIp":      app.DropletIP,
+		"dropletIps":     app.DropletIPs,
+		"loadBalancerIp": app.LoadBalancerIP,
+		"url":            app.URL,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return app, nil
+}
+
+// provisionHost runs the provisioning flow on one host and returns its final
+// health check and the last step run on it.
+func (app *WebApp) provisionHost(ctx *pulumi.Context, host *Host, options commandOptions, cfg *appConfig, unit pulumi.StringOutput) (*remote.Command, pulumi.Resource, error) {
+	var conn = host.Conn
+	app.changeTriggers = append(app.changeTriggers, host.ChangeTriggers...)
+	// • Wait for the host to accept SSH.
+	sshReady, err := waitForSSH(ctx, host.Address, host.Port, cfg.BootTimeout, options, host.Ready)
+	if err != nil {
+		return nil, nil, err
+	}
+	// • Copy over the Systemd manifest, or the compose file.
+	var copyOutput *remote.CopyFile
+	if cfg.Runtime == "compose" {
+		copyOutput, err = copyComposeFile(ctx, conn, options, cfg.Systemd, unit, sshReady)
+	} else {
+		copyOutput, err = copySystemdManifest(ctx, conn, options, cfg.Systemd, unit, sshReady)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	// • Publish the host key fingerprint for known_hosts pinning.
+	err = exportHostKeyFingerprint(ctx, conn, options, copyOutput)
+	if err != nil {
+		return nil, nil, err
+	}
+	// • Register the manifest with Systemd, launch it, and make sure the
+	//   service answers before anything routes to it.
+	started, healthy, err := registerSystemdManifest(ctx, conn, options, cfg, copyOutput, unit)
+	if err != nil {
+		return nil, nil, err
+	}
+	app.changeTriggers = append(app.changeTriggers, started.ID())
+	// • Fetch the tail of the service's logs into the stack outputs.
+	if cfg.TailLogs {
+		if _, err := tailServiceLogs(ctx, cfg, host.Address, options, started); err != nil {
+			return nil, nil, err
+		}
+	}
+	var lastStep pulumi.Resource = healthy
+	// • Clear out image layers left behind by earlier deploys.
+	if cfg.ImagePrunePolicy != "off" {
+		lastStep, err = pruneImages(ctx, conn, options, cfg.ImagePrunePolicy, cfg.ImagePruneOlderThan, healthy)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	// • Start any sidecar containers, such as the monitoring agent.
+	if len(cfg.Systemd.Sidecars) > 0 {
+		lastStep, err = provisionSidecars(ctx, conn, options, cfg.Systemd.Sidecars, lastStep)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	// • Put Caddy in front of the service for automatic HTTPS.
+	if cfg.UseCaddy {
+		caddy, err := provisionCaddy(ctx, conn, options, cfg.hostname(), cfg.TargetPort, cfg.HTTP2, cfg.HTTP3, healthy)
+		if err != nil {
+			return nil, nil, err
+		}
+		app.changeTriggers = append(app.changeTriggers, caddy.ID())
+		lastStep = caddy
+	}
+	return healthy, lastStep, nil
+}